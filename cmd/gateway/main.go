@@ -0,0 +1,141 @@
+/*
+Copyright © 2022 zhuwentao
+*/
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"timeseries/pkg/gateway"
+	"timeseries/pkg/models"
+	influxsvc "timeseries/pkg/service/influxdb"
+	mysqlsvc "timeseries/pkg/service/mysql"
+	"timeseries/pkg/utils/env"
+	"timeseries/pkg/vars"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// mysql config, required by api keys and sensor registry
+	MysqlAddress  = flag.String(vars.MYSQL_ADDRESS, "localhost:3306", "mysql server address")
+	MysqlUser     = flag.String(vars.MYSQL_USER, "", "mysql user")
+	MysqlPassword = flag.String(vars.MYSQL_PASSWORD, "", "mysql password")
+	MysqlDatabase = flag.String(vars.MYSQL_DATABASE, "", "mysql database")
+	// influxdb config
+	InfluxAddress = flag.String(vars.INFLUX_ADDRESS, "localhost", "influx server address")
+	InfluxToken   = flag.String(vars.INFLUX_TOKEN, "", "influx token")
+	InfluxOrg     = flag.String(vars.INFLUX_ORG, "", "influx org")
+	InfluxBucket  = flag.String(vars.INFLUX_BUCKET, "", "influx bucket")
+	// gateway config
+	GatewayConfig = flag.String(vars.GATEWAY_CONFIG, "", "gateway config file (yaml)")
+)
+
+func main() {
+	flag.Parse()
+
+	parseEnvs()
+
+	conf, err := gateway.LoadConfig(*GatewayConfig)
+	if err != nil {
+		logrus.Error("load gateway config failed:", err.Error())
+		return
+	}
+
+	if conf.NeedMysql() {
+		if err := initMysqlService(); err != nil {
+			logrus.Error("init mysql service failed:", err.Error())
+			return
+		}
+	}
+
+	if err := initInfluxService(); err != nil {
+		logrus.Error("init influxdb service failed:", err.Error())
+		return
+	}
+
+	srv := gateway.NewServer(conf)
+
+	startH := make(chan error, 1)
+	go func() {
+		startH <- srv.Start()
+	}()
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-quit:
+		logrus.Info("Shutdown Server ...")
+	case err := <-startH:
+		// never returns before stopped unless the server failed to start
+		logrus.Errorf("service start failed: %v", err)
+		srv.Stop()
+		influxsvc.CloseClient()
+		os.Exit(1)
+	}
+
+	if err := srv.Stop(); err != nil {
+		logrus.Error("Server Shutdown:", err)
+	}
+	influxsvc.CloseClient()
+	logrus.Info("Server exiting")
+}
+
+func parseEnvs() {
+	*InfluxAddress = env.GetEnvString(vars.INFLUX_ADDRESS, *InfluxAddress)
+	*InfluxToken = env.GetEnvString(vars.INFLUX_TOKEN, *InfluxToken)
+	*InfluxOrg = env.GetEnvString(vars.INFLUX_ORG, *InfluxOrg)
+	*InfluxBucket = env.GetEnvString(vars.INFLUX_BUCKET, *InfluxBucket)
+
+	*MysqlAddress = env.GetEnvString(vars.MYSQL_ADDRESS, *MysqlAddress)
+	*MysqlUser = env.GetEnvString(vars.MYSQL_USER, *MysqlUser)
+	*MysqlPassword = env.GetEnvString(vars.MYSQL_PASSWORD, *MysqlPassword)
+	*MysqlDatabase = env.GetEnvString(vars.MYSQL_DATABASE, *MysqlDatabase)
+
+	*GatewayConfig = env.GetEnvString(vars.GATEWAY_CONFIG, *GatewayConfig)
+}
+
+func initMysqlService() error {
+	mysqlAccount := mysqlsvc.Account{
+		Address:  *MysqlAddress,
+		Database: *MysqlDatabase,
+		Username: *MysqlUser,
+		Password: *MysqlPassword,
+	}
+
+	if err := mysqlAccount.Validate(); err != nil {
+		return err
+	}
+
+	mysqlsvc.InitMysqlClient(mysqlAccount)
+
+	if !mysqlsvc.GetClient().Migrator().HasTable(&models.APIKey{}) {
+		if err := mysqlsvc.GetClient().AutoMigrate(&models.APIKey{}); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("init mysql success using config database:%s username:%s url:%s", *MysqlDatabase, *MysqlUser, *MysqlAddress)
+	return nil
+}
+
+func initInfluxService() error {
+	influxAccount := influxsvc.Account{
+		Address: *InfluxAddress,
+		Org:     *InfluxOrg,
+		Token:   *InfluxToken,
+		Bucket:  *InfluxBucket,
+	}
+
+	if err := influxAccount.Validate(); err != nil {
+		return err
+	}
+
+	influxsvc.InitInfluxClient(influxAccount, *InfluxBucket)
+	logrus.Infof("init influx sucess using config bucket:%s org:%s url:%s", *InfluxBucket, *InfluxOrg, *InfluxAddress)
+	return nil
+}
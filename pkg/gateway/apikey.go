@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"timeseries/pkg/models"
+	mysqlsvc "timeseries/pkg/service/mysql"
+)
+
+// tag forced on the points written with an api key
+const projectTagKey = "project_id"
+
+// context key of the project bound to the api key of a request
+const projectContextKey = "gateway.project_id"
+
+// AuthConfig : api key authentication, keys are stored in mysql
+type AuthConfig struct {
+	APIKeys bool `yaml:"api_keys"`
+	// keys are cached, new and disabled keys take effect after refreshed
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+func (c AuthConfig) Validate() error {
+	if c.APIKeys && c.RefreshInterval <= 0 {
+		return fmt.Errorf("gateway: refresh interval of api keys must be positive")
+	}
+	return nil
+}
+
+// hashKey returns the hex sha256 of an api key, as stored in mysql
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyStore looks up the project of an api key
+type keyStore interface {
+	project(key string) (string, bool)
+	close()
+}
+
+// mysqlKeyStore caches the enabled api keys of mysql, refreshed periodically.
+// Unknown keys never hit the database.
+type mysqlKeyStore struct {
+	mu    sync.RWMutex
+	keys  map[string]string // key hash to project id
+	stopH chan struct{}
+}
+
+func newMysqlKeyStore(interval time.Duration) (*mysqlKeyStore, error) {
+	k := &mysqlKeyStore{stopH: make(chan struct{})}
+	if err := k.refresh(); err != nil {
+		return nil, fmt.Errorf("gateway: load api keys failed: %s", err.Error())
+	}
+	go refreshLoop(interval, k.stopH, "api keys", k.refresh)
+	return k, nil
+}
+
+// close stops refreshing
+func (k *mysqlKeyStore) close() {
+	close(k.stopH)
+}
+
+func (k *mysqlKeyStore) refresh() error {
+	var rows []models.APIKey
+	if err := mysqlsvc.GetClient().Where("enabled = ?", true).Find(&rows).Error; err != nil {
+		return err
+	}
+	keys := make(map[string]string, len(rows))
+	for _, r := range rows {
+		keys[r.KeyHash] = strconv.Itoa(r.ProjectId)
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *mysqlKeyStore) project(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	project, ok := k.keys[hashKey(key)]
+	return project, ok
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestToken returns the token of "Authorization: Token xxx" header
+func requestToken(ctx *gin.Context) string {
+	auth := ctx.GetHeader("Authorization")
+	for _, scheme := range []string{"Token ", "Bearer "} {
+		if strings.HasPrefix(auth, scheme) {
+			return strings.TrimSpace(auth[len(scheme):])
+		}
+	}
+	return ""
+}
+
+// requestTokenV1 returns the token of influxdb 1.x requests, which is the password
+// of "u", "p" query params or basic auth, or the token of authorization header
+func requestTokenV1(ctx *gin.Context) string {
+	if p := ctx.Query("p"); p != "" {
+		return p
+	}
+	if _, p, ok := ctx.Request.BasicAuth(); ok {
+		return p
+	}
+	return requestToken(ctx)
+}
+
+// validToken checks the token against the configured tokens,
+// every token is valid when no token configured
+func (s *server) validToken(token string) bool {
+	if len(s.conf.Tokens) == 0 {
+		return true
+	}
+	for _, t := range s.conf.Tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the token, which is either an api key or a configured token.
+// The project bound to an api key is returned, configured tokens have no project.
+func (s *server) authorize(token string) (string, bool) {
+	if s.keys == nil {
+		return "", s.validToken(token)
+	}
+	if project, ok := s.keys.project(token); ok {
+		return project, true
+	}
+	// api keys are required unless tokens are configured
+	return "", len(s.conf.Tokens) > 0 && s.validToken(token)
+}
+
+// authenticate rejects requests of the v2 api without a valid token
+func (s *server) authenticate(ctx *gin.Context) {
+	project, ok := s.authorize(requestToken(ctx))
+	if !ok {
+		replyWriteError(ctx, http.StatusUnauthorized, errCodeUnauthorized, "unauthorized access")
+		ctx.Abort()
+		return
+	}
+	if project != "" {
+		ctx.Set(projectContextKey, project)
+	}
+	ctx.Next()
+}
+
+// authenticateV1 rejects requests of the v1 api without a valid token
+func (s *server) authenticateV1(ctx *gin.Context) {
+	project, ok := s.authorize(requestTokenV1(ctx))
+	if !ok {
+		replyV1(ctx, http.StatusUnauthorized, writeError{Code: errCodeUnauthorized, Message: "authorization failed"})
+		ctx.Abort()
+		return
+	}
+	if project != "" {
+		ctx.Set(projectContextKey, project)
+	}
+	ctx.Next()
+}
@@ -0,0 +1,329 @@
+// Package buffer implements the disk buffer of batches failed to write into
+// influxdb. Batches are kept in files, one for each batch, and forwarded
+// oldest first once influxdb is reachable again.
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	batchExt   = ".batch"
+	tmpExt     = ".tmp"
+	corruptExt = ".corrupt" // batches could not be read are renamed with it
+)
+
+// Config : disk buffer config, disabled when dir is empty
+type Config struct {
+	Dir string `yaml:"dir"`
+	// max bytes of the buffered batches, the oldest batches are evicted when exceeded
+	MaxSize int64 `yaml:"max_size"`
+	// backoff between forward attempts, doubled on every failure up to the max
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+func (c Config) Validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("buffer: max size must be positive")
+	}
+	if c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("buffer: initial backoff must be positive and not larger than max backoff")
+	}
+	return nil
+}
+
+// Batch : line protocol of a failed write
+type Batch struct {
+	Bucket string
+	Lines  string
+	Time   time.Time // when the batch is buffered
+
+	name string
+	size int64
+}
+
+// Status : usage of the buffer
+type Status struct {
+	Enabled bool   `json:"enabled"`
+	Batches int    `json:"batches"`
+	Bytes   int64  `json:"bytes"`
+	MaxSize int64  `json:"max_size"`
+	Evicted uint64 `json:"evicted"` // batches evicted because the buffer is full
+	Corrupt uint64 `json:"corrupt"` // batches dropped because they could not be read
+	// buffered time of the oldest batch, nil when empty
+	Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+// Buffer : fifo of batches on disk, safe for concurrent use
+type Buffer struct {
+	conf Config
+
+	mu      sync.Mutex
+	batches []*Batch // oldest first, lines are not loaded
+	size    int64
+	seq     uint64
+	evicted uint64
+	corrupt uint64
+	// notified when a batch is pushed
+	pushed chan struct{}
+}
+
+// Open loads the batches left in dir, which is created if not exists.
+// Temp files of batches not completely written are removed.
+func Open(conf Config) (*Buffer, error) {
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("buffer: create dir failed: %s", err.Error())
+	}
+	files, err := ioutil.ReadDir(conf.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("buffer: read dir failed: %s", err.Error())
+	}
+
+	b := &Buffer{conf: conf, pushed: make(chan struct{}, 1)}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), batchExt+tmpExt) {
+			if err := os.Remove(filepath.Join(conf.Dir, f.Name())); err != nil {
+				return nil, fmt.Errorf("buffer: remove temp file failed: %s", err.Error())
+			}
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(f.Name(), batchExt) {
+			continue
+		}
+		ts, seq, ok := parseName(f.Name())
+		if !ok {
+			continue
+		}
+		b.batches = append(b.batches, &Batch{Time: ts, name: f.Name(), size: f.Size()})
+		b.size += f.Size()
+		if seq > b.seq {
+			b.seq = seq
+		}
+	}
+	sort.Slice(b.batches, func(i, j int) bool { return b.batches[i].name < b.batches[j].name })
+	return b, nil
+}
+
+// file name of a batch is buffered time and sequence, so names sort by age
+func batchName(ts time.Time, seq uint64) string {
+	return fmt.Sprintf("%020d-%010d%s", ts.UnixNano(), seq, batchExt)
+}
+
+func parseName(name string) (time.Time, uint64, bool) {
+	parts := strings.SplitN(strings.TrimSuffix(name, batchExt), "-", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, false
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(0, ns).UTC(), seq, true
+}
+
+// Push writes a batch to disk, the oldest batches are evicted when the buffer is full
+func (b *Buffer) Push(bucket, lines string) error {
+	content := bucket + "\n" + lines
+	size := int64(len(content))
+	if size > b.conf.MaxSize {
+		return fmt.Errorf("buffer: batch of %d bytes is larger than the buffer", size)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	batch := &Batch{Bucket: bucket, Time: time.Now().UTC(), size: size}
+	batch.name = batchName(batch.Time, b.seq)
+
+	// written to a temp file first, so a crash never leaves a partial batch. Both the
+	// file and the rename are synced, the points are confirmed once buffered.
+	path := filepath.Join(b.conf.Dir, batch.name)
+	if err := writeFileSync(path+tmpExt, []byte(content)); err != nil {
+		os.Remove(path + tmpExt)
+		return fmt.Errorf("buffer: write batch failed: %s", err.Error())
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return fmt.Errorf("buffer: write batch failed: %s", err.Error())
+	}
+	if err := syncDir(b.conf.Dir); err != nil {
+		return fmt.Errorf("buffer: write batch failed: %s", err.Error())
+	}
+
+	for b.size+size > b.conf.MaxSize && len(b.batches) > 0 {
+		oldest := b.batches[0]
+		if err := os.Remove(filepath.Join(b.conf.Dir, oldest.name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("buffer: evict batch failed: %s", err.Error())
+		}
+		b.batches = b.batches[1:]
+		b.size -= oldest.size
+		b.evicted++
+	}
+	b.batches = append(b.batches, batch)
+	b.size += size
+
+	select {
+	case b.pushed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeFileSync writes data to a new file and syncs it to disk
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the entries of dir, so renamed files survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Pushed returns a channel notified after batches are pushed
+func (b *Buffer) Pushed() <-chan struct{} {
+	return b.pushed
+}
+
+// Peek returns the oldest batch, nil when the buffer is empty. Batches could not
+// be read are dropped from the buffer and kept aside as corrupt files, so a bad
+// file never blocks the batches after it.
+func (b *Buffer) Peek() *Batch {
+	for {
+		b.mu.Lock()
+		if len(b.batches) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		batch := *b.batches[0]
+		b.mu.Unlock()
+
+		content, err := ioutil.ReadFile(filepath.Join(b.conf.Dir, batch.name))
+		if err == nil {
+			i := bytes.IndexByte(content, '\n')
+			if i >= 0 {
+				batch.Bucket = string(content[:i])
+				batch.Lines = string(content[i+1:])
+				return &batch
+			}
+			err = fmt.Errorf("no bucket line")
+		}
+		b.drop(&batch, err)
+	}
+}
+
+// drop removes a corrupt batch from the buffer and renames its file. The batch is
+// dropped even if renaming failed, it is found corrupt again after reopened then.
+func (b *Buffer) drop(batch *Batch, cause error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, v := range b.batches {
+		if v.name != batch.name {
+			continue
+		}
+		path := filepath.Join(b.conf.Dir, v.name)
+		if err := os.Rename(path, path+corruptExt); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("rename corrupt batch %s failed: %s", v.name, err.Error())
+		}
+		b.batches = append(b.batches[:i], b.batches[i+1:]...)
+		b.size -= v.size
+		b.corrupt++
+		logrus.Errorf("buffered batch %s could not be read, dropped: %s", v.name, cause.Error())
+		return
+	}
+}
+
+// Remove deletes a batch returned by Peek, nothing happens if it is evicted already
+func (b *Buffer) Remove(batch *Batch) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, v := range b.batches {
+		if v.name != batch.name {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.conf.Dir, v.name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("buffer: remove batch failed: %s", err.Error())
+		}
+		b.batches = append(b.batches[:i], b.batches[i+1:]...)
+		b.size -= v.size
+		return nil
+	}
+	return nil
+}
+
+// Status returns the usage of the buffer
+func (b *Buffer) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := Status{
+		Enabled: true,
+		Batches: len(b.batches),
+		Bytes:   b.size,
+		MaxSize: b.conf.MaxSize,
+		Evicted: b.evicted,
+		Corrupt: b.corrupt,
+	}
+	if len(b.batches) > 0 {
+		oldest := b.batches[0].Time
+		st.Oldest = &oldest
+	}
+	return st
+}
+
+// Backoff : exponential backoff between forward attempts
+type Backoff struct {
+	Initial, Max time.Duration
+	current      time.Duration
+}
+
+// Next returns the delay before the next attempt and doubles it
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.Initial
+	}
+	d := b.current
+	b.current *= 2
+	if b.current > b.Max {
+		b.current = b.Max
+	}
+	return d
+}
+
+// Reset restarts the backoff from the initial delay
+func (b *Backoff) Reset() {
+	b.current = 0
+}
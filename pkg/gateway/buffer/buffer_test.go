@@ -0,0 +1,82 @@
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuffer(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), MaxSize: 40, InitialBackoff: time.Second, MaxBackoff: time.Minute}
+	b, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lines := range []string{"cpu value=1 1\n", "cpu value=2 2\n", "cpu value=3 3\n"} {
+		if err := b.Push("sensors", lines); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each batch takes 22 bytes, the oldest two are evicted
+	if st := b.Status(); st.Batches != 1 || st.Bytes != 22 || st.Evicted != 2 || st.Oldest == nil {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// batches are loaded again after reopen
+	b, err = Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := b.Peek()
+	if batch == nil || batch.Bucket != "sensors" || batch.Lines != "cpu value=3 3\n" {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+	if err := b.Remove(batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch := b.Peek(); batch != nil || b.Status().Bytes != 0 {
+		t.Errorf("buffer not empty after remove")
+	}
+}
+
+func TestCorruptBatches(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), MaxSize: 1 << 20, InitialBackoff: time.Second, MaxBackoff: time.Minute}
+	// a batch without bucket line, a directory named like a batch and a temp file left by a crash
+	os.WriteFile(filepath.Join(conf.Dir, batchName(time.Unix(1, 0), 1)), []byte("cpu value=1 1"), 0644)
+	os.Mkdir(filepath.Join(conf.Dir, batchName(time.Unix(2, 0), 2)), 0755)
+	os.WriteFile(filepath.Join(conf.Dir, batchName(time.Unix(3, 0), 3)+tmpExt), []byte("sensors\ncpu"), 0644)
+	os.WriteFile(filepath.Join(conf.Dir, batchName(time.Unix(4, 0), 4)), []byte("sensors\ncpu value=4 4\n"), 0644)
+
+	b, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(conf.Dir, batchName(time.Unix(3, 0), 3)+tmpExt)); !os.IsNotExist(err) {
+		t.Errorf("temp file not removed")
+	}
+	// corrupt batches never block the valid ones
+	batch := b.Peek()
+	if batch == nil || batch.Lines != "cpu value=4 4\n" {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+	if st := b.Status(); st.Batches != 1 || st.Corrupt != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if _, err := os.Stat(filepath.Join(conf.Dir, batchName(time.Unix(1, 0), 1)+corruptExt)); err != nil {
+		t.Errorf("corrupt batch not kept aside: %s", err.Error())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 3 * time.Second}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if d := b.Next(); d != want {
+			t.Errorf("backoff = %s, want %s", d, want)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Errorf("backoff = %s after reset, want 1s", d)
+	}
+}
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// refreshLoop calls refresh every interval until stopH is closed. Failures are logged
+// and the cached content is kept, name describes the content in logs.
+func refreshLoop(interval time.Duration, stopH <-chan struct{}, name string, refresh func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := refresh(); err != nil {
+				logrus.Errorf("refresh %s failed: %s", name, err.Error())
+			}
+		case <-stopH:
+			return
+		}
+	}
+}
+
+// recentMap holds at most max values by key, the least recently used one is
+// forgotten when a new key is added to a full map. Not safe for concurrent use.
+type recentMap struct {
+	max   int
+	items map[string]*list.Element
+	order *list.List // most recently used first
+}
+
+type recentItem struct {
+	key   string
+	value interface{}
+}
+
+func newRecentMap(max int) *recentMap {
+	return &recentMap{max: max, items: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the value of key and marks it as the most recently used
+func (m *recentMap) get(key string) (interface{}, bool) {
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return elem.Value.(*recentItem).value, true
+}
+
+// add sets the value of a key not in the map, forgetting the least recently used one when full
+func (m *recentMap) add(key string, value interface{}) {
+	if m.order.Len() >= m.max {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*recentItem).key)
+	}
+	m.items[key] = m.order.PushFront(&recentItem{key: key, value: value})
+}
+
+// each calls fn with the values, the most recently used first
+func (m *recentMap) each(fn func(value interface{})) {
+	for elem := m.order.Front(); elem != nil; elem = elem.Next() {
+		fn(elem.Value.(*recentItem).value)
+	}
+}
@@ -0,0 +1,26 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecentMap(t *testing.T) {
+	m := newRecentMap(2)
+	m.add("a", 1)
+	m.add("b", 2)
+	// a is used after b, so b is forgotten first
+	if v, ok := m.get("a"); !ok || v != 1 {
+		t.Fatalf("get a = %v, %v", v, ok)
+	}
+	m.add("c", 3)
+	if _, ok := m.get("b"); ok {
+		t.Errorf("least recently used key not forgotten")
+	}
+
+	var values []interface{}
+	m.each(func(v interface{}) { values = append(values, v) })
+	if want := []interface{}{3, 1}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,203 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"time"
+
+	"timeseries/pkg/gateway/buffer"
+	"timeseries/pkg/gateway/wal"
+	influxsvc "timeseries/pkg/service/influxdb"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config : gateway server config, usually loaded from a yaml file
+type Config struct {
+	Port       int `yaml:"port"`
+	BufferSize int `yaml:"buffer_size"` // capacity of the point process queue
+	Workers    int `yaml:"workers"`     // number of point process workers
+	// max size of a decompressed request body in bytes, 0 means unlimited
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// how long a write waits for room in a full queue before rejected, 0 means reject immediately
+	AdmissionTimeout time.Duration `yaml:"admission_timeout"`
+	// value of the Retry-After header replied to rejected writes
+	RetryAfter time.Duration `yaml:"retry_after"`
+	// how long a synchronous write waits for its points to be stored
+	SyncTimeout time.Duration `yaml:"sync_timeout"`
+	// how long the server waits for running requests on stop, and then for queued points to drain
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// buckets could be written besides the default bucket
+	Buckets []string `yaml:"buckets"`
+	// bucket of the database and retention policy of influxdb 1.x writes
+	DBRP []DBRPMapping `yaml:"dbrp"`
+	// tokens accepted by the write api, authentication is disabled when empty and no api keys
+	Tokens []string `yaml:"tokens"`
+	// api keys of projects, stored in mysql
+	Auth AuthConfig `yaml:"auth"`
+	// transform rules applied to points before validation
+	Transform TransformConfig `yaml:"transform"`
+	// validation and enrichment of points by the sensor registry in mysql
+	Registry RegistryConfig `yaml:"registry"`
+	// drop retransmitted points
+	Dedup DedupConfig `yaml:"dedup"`
+	// acceptance window of timestamps, disabled when no window configured
+	TimePolicy TimePolicyConfig `yaml:"time_policy"`
+	// accept the valid lines of a write while reporting the invalid ones
+	PartialWrites bool `yaml:"partial_writes"`
+
+	Storage   influxsvc.WriteOptions `yaml:"storage"`
+	Publisher PublisherConfig        `yaml:"publisher"`
+	MQTT      MQTTConfig             `yaml:"mqtt"`
+	// udp and tcp listeners of line protocol
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// write-ahead log of accepted points, disabled when dir is empty
+	WAL wal.Config `yaml:"wal"`
+	// disk buffer of batches failed to write while influxdb is unreachable, disabled when dir is empty
+	Buffer buffer.Config `yaml:"buffer"`
+}
+
+// DefaultConfig : config used when no config file provided, fields missing in the
+// config file also keep these values
+func DefaultConfig() Config {
+	return Config{
+		Port:            8086,
+		BufferSize:      10000,
+		Workers:         runtime.NumCPU(),
+		MaxBodySize:     32 << 20,
+		RetryAfter:      time.Second,
+		SyncTimeout:     10 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		Auth: AuthConfig{
+			RefreshInterval: time.Minute,
+		},
+		TimePolicy: TimePolicyConfig{
+			Action: TimeReject,
+		},
+		Dedup: DedupConfig{
+			Window:     10 * time.Minute,
+			MaxEntries: 1000000,
+		},
+		Transform: TransformConfig{
+			ReloadInterval: 10 * time.Second,
+		},
+		Registry: RegistryConfig{
+			Mode:                  RegistryOff,
+			RefreshInterval:       time.Minute,
+			QuarantineMeasurement: "quarantine",
+		},
+		Storage: influxsvc.WriteOptions{
+			BatchSize:     5000,
+			FlushInterval: time.Second,
+			RetryInterval: 5 * time.Second,
+			MaxRetries:    5,
+		},
+		Publisher: PublisherConfig{
+			Type: PublisherNone,
+			Dapr: DaprPublisherConfig{
+				Address:   "http://localhost:3500",
+				Timeout:   5 * time.Second,
+				QueueSize: 10000,
+			},
+		},
+		MQTT: MQTTConfig{
+			ClientID: "timeseries-gateway",
+			QoS:      1,
+		},
+		WAL: wal.Config{
+			SegmentSize:   64 << 20,
+			Fsync:         wal.FsyncInterval,
+			FsyncInterval: 100 * time.Millisecond,
+		},
+		Buffer: buffer.Config{
+			MaxSize:        1 << 30,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+		},
+	}
+}
+
+func (c Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("gateway: invalid port %d", c.Port)
+	}
+	if c.BufferSize <= 0 {
+		return fmt.Errorf("gateway: buffer size must be positive")
+	}
+	if c.Workers <= 0 {
+		return fmt.Errorf("gateway: workers must be positive")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("gateway: max body size could not be negative")
+	}
+	if c.AdmissionTimeout < 0 || c.RetryAfter < 0 {
+		return fmt.Errorf("gateway: admission timeout and retry after could not be negative")
+	}
+	if c.SyncTimeout <= 0 || c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("gateway: sync timeout and shutdown timeout must be positive")
+	}
+	for _, m := range c.DBRP {
+		if m.Database == "" || m.Bucket == "" {
+			return fmt.Errorf("gateway: database and bucket of dbrp mapping could not be empty")
+		}
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return err
+	}
+	if err := c.Transform.Validate(); err != nil {
+		return err
+	}
+	if err := c.Registry.Validate(); err != nil {
+		return err
+	}
+	if err := c.Dedup.Validate(); err != nil {
+		return err
+	}
+	if err := c.TimePolicy.Validate(); err != nil {
+		return err
+	}
+	if err := c.Storage.Validate(); err != nil {
+		return err
+	}
+	if err := c.Publisher.Validate(); err != nil {
+		return err
+	}
+	if err := c.MQTT.Validate(); err != nil {
+		return err
+	}
+	for _, l := range c.Listeners {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.WAL.Validate(); err != nil {
+		return err
+	}
+	if err := c.Buffer.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NeedMysql : whether the mysql client must be initialized before the server starts
+func (c Config) NeedMysql() bool {
+	return c.Auth.APIKeys || c.Registry.Enabled()
+}
+
+// LoadConfig : read config from yaml file, an empty path returns the default config
+func LoadConfig(path string) (Config, error) {
+	conf := DefaultConfig()
+	if path == "" {
+		return conf, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, fmt.Errorf("gateway: read config failed: %s", err.Error())
+	}
+	if err := yaml.Unmarshal(content, &conf); err != nil {
+		return conf, fmt.Errorf("gateway: parse config failed: %s", err.Error())
+	}
+	return conf, conf.Validate()
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := LoadConfig("")
+	if err != nil || conf.Port != DefaultConfig().Port {
+		t.Fatalf("default config = %+v, %v", conf, err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gateway.yaml")
+	os.WriteFile(path, []byte("port: 9000\nworkers: 2\nstorage:\n  batch_size: 100\n"), 0644)
+	conf, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Port != 9000 || conf.Workers != 2 || conf.Storage.BatchSize != 100 {
+		t.Errorf("config not loaded: %+v", conf)
+	}
+	// missing fields keep the defaults
+	if conf.BufferSize != 10000 || conf.Storage.FlushInterval != time.Second {
+		t.Errorf("defaults not kept: %+v", conf)
+	}
+
+	for _, content := range []string{
+		"workers: 0\n",
+		"storage:\n  batch_size: 0\n",
+		"port: [1]\n",
+	} {
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("invalid config %q loaded", content)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("missing config file loaded")
+	}
+}
+
+func TestServerStart(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		written []string
+	)
+	startInflux(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		written = append(written, strings.TrimSpace(string(body)))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.Port = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	s := NewServer(conf)
+	startH := make(chan error, 1)
+	go func() {
+		startH <- s.Start()
+	}()
+	url := "http://" + l.Addr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(url + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not started: %s", err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Post(url+"/api/v2/write", "text/plain", strings.NewReader("cpu,host=a value=1 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	// queued points are stored on stop
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-startH; err != nil {
+		t.Errorf("start: %s", err.Error())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 1 || written[0] != "cpu,host=a value=1 1" {
+		t.Errorf("unexpected writes %v", written)
+	}
+}
@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupConfig : drop points identical to one received within the window, by series and timestamp
+type DedupConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Window  time.Duration `yaml:"window"`
+	// max number of points remembered, the oldest are forgotten first
+	MaxEntries int `yaml:"max_entries"`
+}
+
+func (c DedupConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Window <= 0 || c.MaxEntries <= 0 {
+		return fmt.Errorf("gateway: window and max entries of dedup must be positive")
+	}
+	return nil
+}
+
+// dedupKey identifies a point by series and timestamp
+type dedupKey struct {
+	series uint64
+	ts     int64
+}
+
+// initial capacity of the ring, doubled when full until max entries
+const dedupInitialEntries = 1024
+
+// max number of sensors whose duplicates are counted, the least recently duplicated
+// ones are forgotten
+const maxDuplicateSensors = 1000
+
+type dedupItem struct {
+	key  dedupKey
+	seen time.Time
+}
+
+// dedupStage remembers the points received within the window in a ring, ordered by
+// the time received. Duplicates are dropped without error and counted by sensor.
+type dedupStage struct {
+	conf DedupConfig
+
+	mu    sync.Mutex
+	seen  map[dedupKey]time.Time
+	ring  []dedupItem
+	head  int // index of the oldest item
+	count int
+
+	dupMu      sync.Mutex
+	duplicates *recentMap // of *sensorDuplicates by sensor mac
+	total      uint64
+}
+
+func newDedupStage(conf DedupConfig) *dedupStage {
+	size := dedupInitialEntries
+	if size > conf.MaxEntries {
+		size = conf.MaxEntries
+	}
+	return &dedupStage{
+		conf:       conf,
+		seen:       make(map[dedupKey]time.Time),
+		ring:       make([]dedupItem, size),
+		duplicates: newRecentMap(maxDuplicateSensors),
+	}
+}
+
+func (d *dedupStage) apply(e *entry) error {
+	key := dedupKey{series: e.point.HashID(), ts: e.point.UnixNano()}
+	now := time.Now()
+
+	d.mu.Lock()
+	d.expire(now)
+	if _, ok := d.seen[key]; ok {
+		d.mu.Unlock()
+		d.duplicated(e.point.Tags().GetString(sensorMacTagKey))
+		return errDropped
+	}
+	if d.count == len(d.ring) {
+		if len(d.ring) < d.conf.MaxEntries {
+			d.grow()
+		} else {
+			d.pop()
+		}
+	}
+	d.ring[(d.head+d.count)%len(d.ring)] = dedupItem{key: key, seen: now}
+	d.count++
+	d.seen[key] = now
+	d.mu.Unlock()
+	return nil
+}
+
+// forget removes the points of the entries, which failed to be queued or stored, so
+// retries of them are not dropped. Their items in the ring are ignored when popped.
+func (d *dedupStage) forget(entries []entry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range entries {
+		delete(d.seen, dedupKey{series: entries[i].point.HashID(), ts: entries[i].point.UnixNano()})
+	}
+}
+
+// grow doubles the ring up to max entries, must be called with lock held
+func (d *dedupStage) grow() {
+	size := len(d.ring) * 2
+	if size > d.conf.MaxEntries {
+		size = d.conf.MaxEntries
+	}
+	ring := make([]dedupItem, size)
+	for i := 0; i < d.count; i++ {
+		ring[i] = d.ring[(d.head+i)%len(d.ring)]
+	}
+	d.ring = ring
+	d.head = 0
+}
+
+// expire forgets the points received before the window, must be called with lock held
+func (d *dedupStage) expire(now time.Time) {
+	deadline := now.Add(-d.conf.Window)
+	for d.count > 0 && d.ring[d.head].seen.Before(deadline) {
+		d.pop()
+	}
+}
+
+// pop forgets the oldest point, must be called with lock held
+func (d *dedupStage) pop() {
+	item := d.ring[d.head]
+	if seen, ok := d.seen[item.key]; ok && seen.Equal(item.seen) {
+		delete(d.seen, item.key)
+	}
+	d.head = (d.head + 1) % len(d.ring)
+	d.count--
+}
+
+func (d *dedupStage) duplicated(mac string) {
+	atomic.AddUint64(&d.total, 1)
+	if mac == "" {
+		return
+	}
+	d.dupMu.Lock()
+	defer d.dupMu.Unlock()
+	if v, ok := d.duplicates.get(mac); ok {
+		v.(*sensorDuplicates).Duplicates++
+		return
+	}
+	d.duplicates.add(mac, &sensorDuplicates{SensorMac: mac, Duplicates: 1})
+}
+
+// sensorDuplicates : number of duplicated points of a sensor
+type sensorDuplicates struct {
+	SensorMac  string `json:"sensor_mac"`
+	Duplicates uint64 `json:"duplicates"`
+}
+
+// status returns the total duplicates and the duplicates of each sensor, the most first
+func (d *dedupStage) status() map[string]interface{} {
+	d.dupMu.Lock()
+	sensors := []sensorDuplicates{}
+	d.duplicates.each(func(v interface{}) {
+		sensors = append(sensors, *v.(*sensorDuplicates))
+	})
+	d.dupMu.Unlock()
+	sort.SliceStable(sensors, func(i, j int) bool { return sensors[i].Duplicates > sensors[j].Duplicates })
+	return map[string]interface{}{
+		"duplicates": atomic.LoadUint64(&d.total),
+		"sensors":    sensors,
+	}
+}
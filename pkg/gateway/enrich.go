@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"strconv"
+)
+
+// tags added by enrichment
+const (
+	sensorTypeTagKey     = "sensor_type"
+	sensorTypeNameTagKey = "sensor_type_name"
+	gatherTypeTagKey     = "gather_type"
+	locationNameTagKey   = "location_name"
+)
+
+// tag keys of the location levels
+var locationTagKeys = [4]string{"location_1_id", "location_2_id", "location_3_id", "location_4_id"}
+
+// enrichStage adds the metadata of registered sensors as tags, so queries could filter
+// by project, type and location without joins against mysql. Project id is only added
+// when absent, as it is forced by api keys, and sensors registered in another project than
+// the forced one are not enriched. Other tags are replaced by the registry values.
+type enrichStage struct {
+	registry *registry
+}
+
+func (en *enrichStage) apply(e *entry) error {
+	tags := e.point.Tags()
+	mac := tags.GetString(sensorMacTagKey)
+	if mac == "" {
+		return nil
+	}
+	data := en.registry.snapshot()
+	sensor, ok := data.sensor(mac, e.project)
+	if !ok {
+		return nil
+	}
+
+	tags = tags.Clone()
+	if tags.GetString(projectTagKey) == "" {
+		tags.SetString(projectTagKey, strconv.Itoa(sensor.ProjectId))
+	}
+	tags.SetString(sensorTypeTagKey, strconv.Itoa(sensor.TypeId))
+	if t, ok := data.sensorTypes[sensor.TypeId]; ok && t.TypeName != "" {
+		tags.SetString(sensorTypeNameTagKey, t.TypeName)
+	}
+	if t, ok := data.gatherType(sensor, tags.GetString(receiveNoTagKey)); ok && t.GatherType != "" {
+		tags.SetString(gatherTypeTagKey, t.GatherType)
+	}
+
+	ids := [4]int{sensor.Location1Id, sensor.Location2Id, sensor.Location3Id, sensor.Location4Id}
+	for i, id := range ids {
+		if id != 0 {
+			tags.SetString(locationTagKeys[i], strconv.Itoa(id))
+		}
+	}
+	if l, ok := data.locations[locationKey{project: sensor.ProjectId, ids: ids}]; ok && l.LocationName != "" {
+		tags.SetString(locationNameTagKey, l.LocationName)
+	}
+	e.point.SetTags(tags)
+	return nil
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"timeseries/pkg/models"
+)
+
+// tag keys rejected by the line protocol parser
+var reservedTagKeys = []string{"time", "_field", "_measurement", models.FieldKeyTagKey, models.MeasurementTagKey}
+
+// newPoint builds a point with the same validation as parsing line protocol
+func newPoint(name string, tags map[string]string, fields models.Fields, t time.Time) (models.Point, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing measurement")
+	}
+	for _, key := range reservedTagKeys {
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("cannot use reserved tag key %q", key)
+		}
+	}
+	for k, v := range tags {
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("tag key and value could not be empty")
+		}
+	}
+	t2 := models.NewTags(tags)
+	if !models.ValidKeyTokens(name, t2) {
+		return nil, fmt.Errorf("key contains invalid unicode")
+	}
+	return models.NewPoint(name, t2, fields, t)
+}
+
+// setTag adds or replaces a tag of the point
+func setTag(p models.Point, key, value string) {
+	tags := p.Tags().Clone()
+	tags.SetString(key, value)
+	p.SetTags(tags)
+}
+
+// parseTime parses a timestamp in the precision or a RFC3339 time,
+// the default time is returned for an empty string
+func parseTime(v string, precision string, defaultTime time.Time) (time.Time, error) {
+	if v == "" {
+		return defaultTime, nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return models.SafeCalcTime(ts, precision)
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s", v)
+	}
+	return t.UTC(), models.CheckTime(t)
+}
+
+// jsonPointInput : element of a json write body
+type jsonPointInput struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        interface{}            `json:"time"` // timestamp in precision or RFC3339 time
+}
+
+func (in jsonPointInput) toPoint(precision string, defaultTime time.Time) (models.Point, error) {
+	fields := make(models.Fields, len(in.Fields))
+	for k, v := range in.Fields {
+		switch v := v.(type) {
+		case json.Number:
+			// numbers are floats, the same as line protocol without a type suffix
+			f, err := v.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid number of field %s", k)
+			}
+			fields[k] = f
+		case string, bool:
+			fields[k] = v
+		default:
+			return nil, fmt.Errorf("unsupported value of field %s", k)
+		}
+	}
+
+	var ts string
+	switch v := in.Time.(type) {
+	case nil:
+	case json.Number:
+		ts = v.String()
+	case string:
+		ts = v
+	default:
+		return nil, fmt.Errorf("invalid time %v", v)
+	}
+	t, err := parseTime(ts, precision, defaultTime)
+	if err != nil {
+		return nil, err
+	}
+	return newPoint(in.Measurement, in.Tags, fields, t)
+}
+
+// readJSON decodes a json array of points into the write request, elements are
+// decoded one by one. Line numbers of errors are the 1-based indexes of elements.
+func (s *server) readJSON(w *writeRequest, body io.Reader, precision string) error {
+	now := time.Now().UTC()
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("json body must be an array of points")
+	}
+	for i := 1; decoder.More(); i++ {
+		var in jsonPointInput
+		if err := decoder.Decode(&in); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				// the element is consumed, continue with the next one
+				w.fail(i, fmt.Errorf("unable to parse point: %s", err.Error()))
+				continue
+			}
+			return err
+		}
+		p, err := in.toPoint(precision, now)
+		if err != nil {
+			w.fail(i, fmt.Errorf("unable to parse point: %s", err.Error()))
+			continue
+		}
+		if !w.add(i, p) {
+			return nil
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// csvOptions maps the columns of a csv body to a point, the first row is the header.
+// Columns neither measurement, time nor tag are fields.
+type csvOptions struct {
+	measurement       string // measurement of all rows, used when no measurement column
+	measurementColumn string
+	timeColumn        string
+	tagColumns        map[string]bool
+}
+
+// parseCsvValue : empty values are skipped, others are bool, float or string
+func parseCsvValue(v string) (interface{}, bool) {
+	if v == "" {
+		return nil, false
+	}
+	if b, err := strconv.ParseBool(v); err == nil && (v == "true" || v == "false") {
+		return b, true
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f, true
+	}
+	return v, true
+}
+
+// readCSV reads a csv body row by row into the write request
+func (s *server) readCSV(w *writeRequest, body io.Reader, precision string, opts csvOptions) error {
+	now := time.Now().UTC()
+	reader := csv.NewReader(body)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header = append([]string(nil), header...)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+				w.fail(parseErr.StartLine, fmt.Errorf("unable to parse row: %s", parseErr.Err.Error()))
+				continue
+			}
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+
+		measurement := opts.measurement
+		var ts string
+		tags := make(map[string]string)
+		fields := make(models.Fields)
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch {
+			case column == opts.measurementColumn:
+				if value != "" {
+					measurement = value
+				}
+			case column == opts.timeColumn:
+				ts = value
+			case opts.tagColumns[column]:
+				if value != "" {
+					tags[column] = value
+				}
+			default:
+				if v, ok := parseCsvValue(value); ok {
+					fields[column] = v
+				}
+			}
+		}
+		t, err := parseTime(ts, precision, now)
+		if err != nil {
+			w.fail(line, fmt.Errorf("unable to parse row: %s", err.Error()))
+			continue
+		}
+		p, err := newPoint(measurement, tags, fields, t)
+		if err != nil {
+			w.fail(line, fmt.Errorf("unable to parse row: %s", err.Error()))
+			continue
+		}
+		if !w.add(line, p) {
+			return nil
+		}
+	}
+}
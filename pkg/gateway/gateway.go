@@ -1,110 +1,441 @@
 package gateway
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/sirupsen/logrus"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"time"
+	"sync"
+
 	"timeseries/pkg/api"
+	"timeseries/pkg/gateway/buffer"
+	"timeseries/pkg/gateway/wal"
 	"timeseries/pkg/models"
+	influxsvc "timeseries/pkg/service/influxdb"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
 )
 
+// api.Service is implemented by the gateway server
+var _ api.Service = (*server)(nil)
+
+// ErrServerStopping is returned when points arrive after the server began to stop
+var ErrServerStopping = errors.New("server is stopping")
+
 type server struct {
 	httpMux *gin.Engine
+	httpSrv *http.Server
 	port    int
+	conf    Config
+	// org and default bucket of the influxdb account
+	org    string
+	bucket string
+
+	storage   storage
+	publisher Publisher
+	stats     *stats
+	metrics   *metrics
+	mqtt      *mqttSource
+	listeners []*socketListener
+	wal       *wal.Log
+	buffer    *buffer.Buffer
+	keys      keyStore // nil when api keys are disabled
+
+	// pipeline stages run on points before queued, nil when disabled
+	registry   *registry
+	transform  *transformStage
+	timePolicy *timePolicyStage
+	dedup      *dedupStage
+	stages     []stage
 
-	// point process queue
-	queue chan models.Point
-	// stop signal
+	// running wal truncation
+	walWg sync.WaitGroup
+
+	// point process queues, one for each worker
+	queues []chan entry
+	// reserves room in the queue for the received points
+	admission *semaphore.Weighted
+	// guards queue against sending after it is closed
+	mu     sync.RWMutex
+	closed bool
+	// stop signal, abort processing the rest of queue
 	stopH chan struct{}
+	// closed when all process workers exit
+	doneH    chan struct{}
+	stopOnce sync.Once
 }
 
-func NewServer(port, buffSize int) *server {
-	return &server{
-		httpMux: gin.New(),
-		port:    port,
-		queue:   make(chan models.Point, buffSize),
-		stopH:   make(chan struct{}),
+func NewServer(conf Config) *server {
+	s := &server{
+		httpMux:   gin.New(),
+		port:      conf.Port,
+		conf:      conf,
+		stats:     &stats{},
+		queues:    make([]chan entry, conf.Workers),
+		admission: semaphore.NewWeighted(int64(conf.BufferSize)),
+		stopH:     make(chan struct{}),
+		doneH:     make(chan struct{}),
+	}
+	// each queue is able to hold all admitted points, so sending never blocks
+	for i := range s.queues {
+		s.queues[i] = make(chan entry, conf.BufferSize)
 	}
+	s.metrics = newMetrics(s.stats, s.queues)
+	s.httpSrv = &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.Port),
+		Handler: s.httpMux,
+	}
+	return s
 }
 
 func (s *server) Start() error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	if err := s.httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.Errorf("http server exist with error: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// init prepares publisher, storage and routes, then starts the process workers
+func (s *server) init() error {
+	if s.publisher == nil {
+		publisher, err := NewPublisher(s.conf.Publisher)
+		if err != nil {
+			return err
+		}
+		s.publisher = publisher
+	}
+	if s.conf.Buffer.Dir != "" {
+		buf, err := buffer.Open(s.conf.Buffer)
+		if err != nil {
+			return err
+		}
+		s.buffer = buf
+	}
+	if s.storage == nil {
+		// influxdb client must be initialized before the server starts
+		account := influxsvc.GetAccount()
+		s.org, s.bucket = account.Org, account.Bucket
+		s.storage = newInfluxStorage(s.conf.Storage, s.metrics.storageClient(), s.stats, s.buffer, s.conf.Buffer, s.walDone)
+	}
+	// started with storage, so stop always waits for them once storage is set
+	workers := &sync.WaitGroup{}
+	for i := range s.queues {
+		workers.Add(1)
+		go func(queue chan entry) {
+			defer workers.Done()
+			s.process(queue)
+		}(s.queues[i])
+	}
+	go func() {
+		workers.Wait()
+		close(s.doneH)
+	}()
+
+	if s.conf.Auth.APIKeys && s.keys == nil {
+		// mysql client must be initialized before the server starts
+		keys, err := newMysqlKeyStore(s.conf.Auth.RefreshInterval)
+		if err != nil {
+			return err
+		}
+		s.keys = keys
+	}
+
+	if s.conf.Registry.Enabled() && s.registry == nil {
+		reg, err := newRegistry(loadRegistry, s.conf.Registry.RefreshInterval)
+		if err != nil {
+			return err
+		}
+		s.registry = reg
+	}
+	if s.conf.Transform.File != "" {
+		transform, err := newTransformStage(s.conf.Transform, s.registry)
+		if err != nil {
+			return err
+		}
+		s.transform = transform
+	}
+	if s.conf.TimePolicy.Enabled() {
+		timePolicy, err := newTimePolicyStage(s, s.conf.TimePolicy)
+		if err != nil {
+			return err
+		}
+		s.timePolicy = timePolicy
+	}
+	if s.conf.Dedup.Enabled {
+		s.dedup = newDedupStage(s.conf.Dedup)
+	}
+	s.stages = s.buildStages()
+
 	s.registerRoutes()
 
-	go s.process()
+	// points left by the last run are queued before accepting new ones
+	if s.conf.WAL.Dir != "" {
+		log, err := wal.Open(s.conf.WAL)
+		if err != nil {
+			return err
+		}
+		s.wal = log
+		if err := s.replayWAL(); err != nil {
+			return err
+		}
+		s.walWg.Add(1)
+		go s.truncateWAL()
+	}
 
-	if err := s.httpMux.Run(fmt.Sprintf(":%d", s.port)); err != nil {
-		logrus.Errorf("http server exist with error: %s", err.Error())
+	if s.conf.MQTT.Broker != "" {
+		source, err := newMQTTSource(s, s.conf.MQTT)
+		if err != nil {
+			return err
+		}
+		source.start()
+		s.mqtt = source
+	}
+	for _, c := range s.conf.Listeners {
+		l, err := newSocketListener(s, c)
+		if err != nil {
+			return err
+		}
+		if err := l.start(); err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, l)
 	}
 	return nil
 }
 
+// Stop stops accepting points, then drains the queued points to storage and publisher.
+// Running requests and the queued points are waited for within the shutdown timeout
+// each, points still queued after the timeout are lost and counted.
 func (s *server) Stop() error {
-	// close stop channel for send signal to all goroutines
-	close(s.stopH)
+	var err error
+	s.stopOnce.Do(func() {
+		err = s.shutdown()
+	})
+	return err
+}
+
+func (s *server) shutdown() error {
+	// stop listening and wait for the running requests
+	httpCtx, cancel := context.WithTimeout(context.Background(), s.conf.ShutdownTimeout)
+	if err := s.httpSrv.Shutdown(httpCtx); err != nil {
+		logrus.Warnf("http server shutdown: %s", err.Error())
+	}
+	cancel()
+	if s.mqtt != nil {
+		s.mqtt.stop()
+	}
+	for _, l := range s.listeners {
+		l.stop()
+	}
+
+	// no more points could be sent to queues
+	s.mu.Lock()
+	s.closed = true
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.mu.Unlock()
+
+	if s.storage == nil {
+		// never started
+		return nil
+	}
+
+	// a slow http shutdown never takes the time of draining
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.conf.ShutdownTimeout)
+	defer cancel()
+	select {
+	case <-s.doneH:
+	case <-drainCtx.Done():
+		// close stop channel for send signal to all goroutines
+		close(s.stopH)
+		<-s.doneH
+	}
+
+	lost := 0
+	for _, queue := range s.queues {
+		for e := range queue {
+			if e.ack != nil {
+				e.ack.done(ErrServerStopping)
+			}
+			lost++
+		}
+	}
+	s.stats.add(&s.stats.lost, lost)
+
+	if s.keys != nil {
+		s.keys.close()
+	}
+	if s.registry != nil {
+		s.registry.close()
+	}
+	if s.transform != nil {
+		s.transform.close()
+	}
+	s.walWg.Wait()
+	s.storage.close()
+	if err := s.publisher.Close(); err != nil {
+		logrus.Warnf("close publisher failed: %s", err.Error())
+	}
+	if s.wal != nil {
+		// segments of the lost points are kept for replay
+		s.closeWAL()
+	}
+
+	if lost > 0 {
+		logrus.Errorf("stop point process, %d points lost", lost)
+		return fmt.Errorf("gateway: %d points lost on shutdown", lost)
+	}
+	logrus.Infof("stop point process, all points drained")
 	return nil
 }
 
+// workerStatus : queue status of a process worker
+type workerStatus struct {
+	Worker        int `json:"worker"`
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+}
+
+func (s *server) status() map[string]interface{} {
+	workers := make([]workerStatus, len(s.queues))
+	for i, queue := range s.queues {
+		workers[i] = workerStatus{Worker: i, QueueDepth: len(queue), QueueCapacity: cap(queue)}
+	}
+	listeners := make([]listenerStatus, len(s.listeners))
+	for i, l := range s.listeners {
+		listeners[i] = l.snapshot()
+	}
+	return map[string]interface{}{
+		"counters":  s.stats.snapshot(),
+		"workers":   workers,
+		"listeners": listeners,
+	}
+}
+
+// bufferStatus returns the usage of the disk buffer
+func (s *server) bufferStatus() buffer.Status {
+	if s.buffer == nil {
+		return buffer.Status{}
+	}
+	return s.buffer.Status()
+}
+
+// Publisher : return the publisher in use, nil before the server started.
+// In-process consumers can subscribe to it when the bus publisher is selected.
+func (s *server) Publisher() Publisher {
+	return s.publisher
+}
+
 func (s *server) registerRoutes() {
+	s.httpMux.Use(s.metrics.instrument)
+	s.httpMux.Handle(http.MethodGet, "/metrics", s.metrics.handler())
 	s.httpMux.Handle(http.MethodGet, "/healthz", func(ctx *gin.Context) {
 		ctx.JSON(http.StatusOK, map[string]interface{}{"status": "ok"})
 	})
+	s.httpMux.Handle(http.MethodGet, "/status", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, api.ReplyJson{Data: s.status()})
+	})
+	s.httpMux.Handle(http.MethodGet, "/status/buffer", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, api.ReplyJson{Data: s.bufferStatus()})
+	})
+	s.httpMux.Handle(http.MethodGet, "/status/unknown-sensors", func(ctx *gin.Context) {
+		sensors := []unknownSensor{}
+		if s.registry != nil {
+			sensors = s.registry.unknownSensors()
+		}
+		ctx.JSON(http.StatusOK, api.ReplyJson{Data: sensors})
+	})
+	s.httpMux.Handle(http.MethodGet, "/status/time-violations", func(ctx *gin.Context) {
+		offenders := []timeOffender{}
+		if s.timePolicy != nil {
+			offenders = s.timePolicy.violations()
+		}
+		ctx.JSON(http.StatusOK, api.ReplyJson{Data: offenders})
+	})
+	s.httpMux.Handle(http.MethodGet, "/status/duplicates", func(ctx *gin.Context) {
+		if s.dedup == nil {
+			ctx.JSON(http.StatusOK, api.ReplyJson{Data: map[string]interface{}{"enabled": false}})
+			return
+		}
+		ctx.JSON(http.StatusOK, api.ReplyJson{Data: s.dedup.status()})
+	})
 
-	apiRouteV2 := s.httpMux.Group("/api/v2")
+	apiRouteV2 := s.httpMux.Group("/api/v2", s.authenticate)
 	{
 		apiRouteV2.Handle(http.MethodPost, "/write", s.pointReceiver)
 	}
+
+	// influxdb 1.x compatible api
+	s.httpMux.Handle(http.MethodGet, "/ping", s.v1Ping)
+	s.httpMux.Handle(http.MethodHead, "/ping", s.v1Ping)
+	s.httpMux.Handle(http.MethodPost, "/write", s.authenticateV1, s.v1PointReceiver)
+	s.httpMux.Handle(http.MethodGet, "/query", s.authenticateV1, s.v1Query)
+	s.httpMux.Handle(http.MethodPost, "/query", s.authenticateV1, s.v1Query)
 }
 
-func (s *server) pointReceiver(ctx *gin.Context) {
-	precision := ctx.Query("precision")
-	if precision == "" {
-		precision = "n"
-	}
-	body, _ := ioutil.ReadAll(ctx.Request.Body)
-	points, err := models.ParsePointsWithPrecision(body, time.Now().UTC(), precision)
-	if err != nil {
-		if err == io.EOF {
-			ctx.JSON(http.StatusOK, nil)
+// process handles the points of one queue in order
+func (s *server) process(queue <-chan entry) {
+	for {
+		// the stop signal goes first, otherwise the rest of queue may be picked
+		select {
+		case <-s.stopH:
+			return
+		default:
+		}
+		select {
+		case e, ok := <-queue:
+			if !ok {
+				return
+			}
+			if e.ack != nil {
+				// stored and published by the sender in one batch
+				e.ack.add(e)
+			} else {
+				s.storeToInfluxdb(e.bucket, e.point, e.segment)
+				s.publish(e.point)
+			}
+			s.admission.Release(1)
+		case <-s.stopH:
 			return
 		}
-		ctx.JSON(http.StatusBadRequest, api.ReplyError{Code: api.RequestBodyError, Msg: err.Error()})
-		return
 	}
-	// response with async
-	go s.write(points)
-	ctx.JSON(http.StatusNoContent, nil)
 }
 
-func (s *server) write(points []models.Point) {
-	for i := range points {
-		s.queue <- points[i]
-	}
+// write point to influxdb, the wal segment is done after storage confirmed the point
+func (s *server) storeToInfluxdb(bucket string, p models.Point, segment uint64) {
+	s.storage.write(bucket, p, segment)
 }
 
-func (s *server) process() {
-	for {
-		select {
-		case p := <-s.queue:
-			s.storeToInfluxdb(p)
+// write the points collected by a synchronous write to influxdb, one batch for each
+// bucket, and wait for the confirmation. The points are published once all stored.
+func (s *server) storeToInfluxdbSync(ctx context.Context, a *ack) error {
+	for _, bucket := range a.buckets {
+		if err := s.storage.writeBatch(ctx, bucket, a.points[bucket]); err != nil {
+			return err
+		}
+	}
+	for _, bucket := range a.buckets {
+		for _, p := range a.points[bucket] {
 			s.publish(p)
-		case <-s.stopH:
-			logrus.Infof("stop point process")
-			break
 		}
 	}
+	return nil
 }
 
-// write point to influxdb
-func (s *server) storeToInfluxdb(p models.Point) {
-
-}
-
-// publish point to dapr
+// publish point to downstream consumers
 func (s *server) publish(p models.Point) {
-
+	if err := s.publisher.Publish(p); err != nil {
+		s.stats.add(&s.stats.pubErrors, 1)
+		logrus.Warnf("publish point failed: %s", err.Error())
+		return
+	}
+	s.stats.add(&s.stats.published, 1)
 }
@@ -0,0 +1,1114 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"timeseries/pkg/gateway/wal"
+	"timeseries/pkg/models"
+
+	"gopkg.in/yaml.v2"
+)
+
+type memoryStorage struct {
+	mu      sync.Mutex
+	points  []models.Point
+	buckets []string
+	// batches of synchronous writes, which fail with err when set
+	batches int
+	err     error
+	// confirms the wal segments of the points written
+	confirm confirmFunc
+}
+
+func (m *memoryStorage) write(bucket string, p models.Point, segment uint64) {
+	m.mu.Lock()
+	m.points = append(m.points, p)
+	m.buckets = append(m.buckets, bucket)
+	m.mu.Unlock()
+	if m.confirm != nil {
+		m.confirm(segment, 1)
+	}
+}
+
+func (m *memoryStorage) writeBatch(_ context.Context, bucket string, points []models.Point) error {
+	m.mu.Lock()
+	m.batches++
+	err := m.err
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		m.write(bucket, p, 0)
+	}
+	return nil
+}
+
+func (m *memoryStorage) close() {}
+
+func (m *memoryStorage) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.points)
+}
+
+// newTestServer starts a server with memory storage, setup is called before init
+func newTestServer(t *testing.T, conf Config, setup ...func(s *server)) (*server, *memoryStorage) {
+	store := &memoryStorage{}
+	s := NewServer(conf)
+	store.confirm = s.walDone
+	s.storage = store
+	s.org, s.bucket = "org", "default"
+	for _, fn := range setup {
+		fn(s)
+	}
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	return s, store
+}
+
+func doRequest(s *server, method, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.httpMux.ServeHTTP(w, req)
+	return w
+}
+
+func TestPointReceiver(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Workers = 2
+	conf.MaxBodySize = 1024
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("cpu,host=a value=1 1\ncpu,host=b value=2 2\n"))
+	zw.Close()
+
+	tests := []struct {
+		name    string
+		target  string
+		body    []byte
+		headers map[string]string
+		code    int
+		stored  int
+	}{
+		{
+			name:   "lines with comment and quoted newline",
+			body:   []byte("# comment\ncpu,host=a value=1 1\n\nlog,host=a msg=\"multi\nline\" 2\n"),
+			code:   http.StatusNoContent,
+			stored: 2,
+		},
+		{
+			name:    "gzip body",
+			body:    gz.Bytes(),
+			headers: map[string]string{"Content-Encoding": "gzip"},
+			code:    http.StatusNoContent,
+			stored:  2,
+		},
+		{
+			name: "invalid line",
+			body: []byte("cpu,host=a value=1 1\ncpu,host=a\n"),
+			code: http.StatusBadRequest,
+		},
+		{
+			name:   "partial write",
+			target: "/api/v2/write?sync=true&partial=true",
+			body:   []byte("cpu,host=a value=1 1\ncpu,host=a\ncpu,host=b value=2 2\n"),
+			code:   http.StatusBadRequest,
+			stored: 2,
+		},
+		{
+			name:   "unknown bucket",
+			target: "/api/v2/write?org=org&bucket=other",
+			body:   []byte("cpu,host=a value=1 1\n"),
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "invalid precision",
+			target: "/api/v2/write?precision=n",
+			body:   []byte("cpu,host=a value=1 1\n"),
+			code:   http.StatusBadRequest,
+		},
+		{
+			name: "body too large",
+			body: []byte(strings.Repeat("cpu,host=a value=1 1\n", 100)),
+			code: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store := newTestServer(t, conf)
+			target := tt.target
+			if target == "" {
+				target = "/api/v2/write?sync=true"
+			}
+			w := doRequest(s, http.MethodPost, target, tt.body, tt.headers)
+			if w.Code != tt.code {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if store.count() != tt.stored {
+				t.Errorf("stored = %d, want %d", store.count(), tt.stored)
+			}
+			if err := s.Stop(); err != nil {
+				t.Errorf("stop: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	conf := DefaultConfig()
+	conf.BufferSize = 2
+	s := NewServer(conf)
+	s.storage = &memoryStorage{}
+	s.registerRoutes()
+
+	// workers are not started, so the queue is never drained
+	w := doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=1 1\ncpu value=2 2\n"), nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	w = doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=3 3\n"), nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("missing Retry-After header")
+	}
+
+	// waits for room within the admission timeout
+	s.conf.AdmissionTimeout = time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, queue := range s.queues {
+			select {
+			case <-queue:
+				s.admission.Release(1)
+				return
+			default:
+			}
+		}
+	}()
+	w = doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=3 3\n"), nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	s.conf.AdmissionTimeout = 10 * time.Millisecond
+	w = doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=4 4\n"), nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestSyncWrite(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Workers = 4
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	var body bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&body, "cpu,host=h%d value=%d %d\n", i%100, i, i)
+	}
+	w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body.Bytes(), nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	// stored before replied, in one batch
+	if store.count() != 5000 || store.batches != 1 {
+		t.Fatalf("stored = %d in %d batches, want 5000 in 1", store.count(), store.batches)
+	}
+
+	store.err = errors.New("influxdb unavailable")
+	w = doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("cpu value=1 1\n"), nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("code = %d, want %d with Retry-After", w.Code, http.StatusServiceUnavailable)
+	}
+	// published only after stored
+	if published := s.stats.snapshot()["points_published"]; published != 5000 {
+		t.Errorf("published = %d, want 5000", published)
+	}
+
+	// points not processed within the sync timeout
+	conf.SyncTimeout = 10 * time.Millisecond
+	s = NewServer(conf)
+	s.storage = &memoryStorage{}
+	s.registerRoutes()
+	w = doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("cpu value=1 1\n"), nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// a later chunk failed to queue, the points queued before are never stored
+	// half, so the retry stores all of them
+	conf.BufferSize = 2
+	conf.AdmissionTimeout = 100 * time.Millisecond
+	conf.Dedup = DedupConfig{Enabled: true, Window: time.Minute, MaxEntries: 100}
+	s = NewServer(conf)
+	mem := &memoryStorage{}
+	s.storage = mem
+	s.publisher = noopPublisher{}
+	s.dedup = newDedupStage(conf.Dedup)
+	s.stages = s.buildStages()
+	s.registerRoutes()
+	body.Reset()
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&body, "cpu value=%d %d\n", i, i)
+	}
+	w = doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body.Bytes(), nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	for _, queue := range s.queues {
+		go s.process(queue)
+	}
+	w = doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body.Bytes(), nil)
+	if w.Code != http.StatusNoContent || mem.count() != 4 {
+		t.Fatalf("code = %d, stored = %d, want %d and 4", w.Code, mem.count(), http.StatusNoContent)
+	}
+	if published := s.stats.snapshot()["points_published"]; published != 4 {
+		t.Errorf("published = %d, want 4", published)
+	}
+	close(s.stopH)
+}
+
+// blockingStorage holds the writes until released
+type blockingStorage struct {
+	memoryStorage
+	release chan struct{}
+}
+
+func (b *blockingStorage) write(bucket string, p models.Point, segment uint64) {
+	<-b.release
+	b.memoryStorage.write(bucket, p, segment)
+}
+
+func TestShutdown(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Workers = 2
+	s, store := newTestServer(t, conf)
+	var body bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&body, "cpu,host=h%d value=%d %d\n", i%10, i, i)
+	}
+	if w := doRequest(s, http.MethodPost, "/api/v2/write", body.Bytes(), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	// queued points are drained
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if store.count() != 1000 {
+		t.Errorf("stored = %d, want 1000", store.count())
+	}
+	if w := doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=1 1\n"), nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d after stopped, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// points not drained within the timeout are lost
+	conf.Workers = 1
+	conf.ShutdownTimeout = 50 * time.Millisecond
+	blocking := &blockingStorage{release: make(chan struct{})}
+	s, _ = newTestServer(t, conf, func(s *server) { s.storage = blocking })
+	if w := doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=1 1\ncpu value=2 2\ncpu value=3 3\n"), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	time.AfterFunc(200*time.Millisecond, func() { close(blocking.release) })
+	start := time.Now()
+	err := s.Stop()
+	if err == nil || !strings.Contains(err.Error(), "2 points lost") {
+		t.Errorf("error = %v, want 2 points lost", err)
+	}
+	if lost := s.stats.snapshot()["points_lost"]; lost != 2 || blocking.count() != 1 {
+		t.Errorf("lost = %d, stored = %d, want 2 and 1", lost, blocking.count())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("stop took %s", time.Since(start))
+	}
+}
+
+func TestWorkerPartition(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Workers = 4
+	s, store := newTestServer(t, conf)
+
+	// points of a series are stored in the order received
+	for r := 0; r < 10; r++ {
+		var body bytes.Buffer
+		for i := 0; i < 200; i++ {
+			fmt.Fprintf(&body, "cpu,host=h%d value=1 %d\n", i%20, r*200+i)
+		}
+		if w := doRequest(s, http.MethodPost, "/api/v2/write", body.Bytes(), nil); w.Code != http.StatusNoContent {
+			t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+		}
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if store.count() != 2000 {
+		t.Fatalf("stored = %d, want 2000", store.count())
+	}
+	latest := make(map[string]int64)
+	for _, p := range store.points {
+		host := p.Tags().GetString("host")
+		if ts := p.UnixNano(); ts <= latest[host] && latest[host] != 0 {
+			t.Fatalf("point of %s at %d stored after %d", host, ts, latest[host])
+		}
+		latest[host] = p.UnixNano()
+	}
+
+	// workers are not started, points stay in the queue of their series
+	conf.Workers = 3
+	s = NewServer(conf)
+	s.storage = &memoryStorage{}
+	s.registerRoutes()
+	want := make([]int, conf.Workers)
+	var body bytes.Buffer
+	for i := 0; i < 30; i++ {
+		line := fmt.Sprintf("cpu,host=h%d value=1 %d", i%7, i)
+		p, err := models.ParsePointsString(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[p[0].HashID()%uint64(conf.Workers)]++
+		body.WriteString(line + "\n")
+	}
+	doRequest(s, http.MethodPost, "/api/v2/write", body.Bytes(), nil)
+	w := doRequest(s, http.MethodGet, "/status", nil, nil)
+	var reply struct {
+		Data struct {
+			Workers []workerStatus `json:"workers"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Data.Workers) != conf.Workers {
+		t.Fatalf("workers = %+v", reply.Data.Workers)
+	}
+	for i, status := range reply.Data.Workers {
+		if status.Worker != i || status.QueueDepth != want[i] || status.QueueCapacity != conf.BufferSize {
+			t.Errorf("worker %d status = %+v, want depth %d", i, status, want[i])
+		}
+	}
+}
+
+func TestPartialWriteErrors(t *testing.T) {
+	conf := DefaultConfig()
+	conf.PartialWrites = true
+	s, _ := newTestServer(t, conf)
+	defer s.Stop()
+
+	w := doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=1 1\ncpu\n\ncpu value=\n"), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	var reply writeError
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != errCodeInvalid || reply.Line != 2 || len(reply.Errors) != 2 || reply.Errors[1].Line != 4 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Tokens = []string{"secret"}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("cpu value=1 1\n"), nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = doRequest(s, http.MethodPost, "/api/v2/write?sync=true&bucket=default", []byte("cpu value=1 1\n"), map[string]string{"Authorization": "Token secret"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if store.count() != 1 || store.buckets[0] != "default" {
+		t.Errorf("unexpected stored points %v", store.buckets)
+	}
+}
+
+func TestV1Write(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Tokens = []string{"secret"}
+	conf.Buckets = []string{"telegraf/autogen", "sensors"}
+	conf.DBRP = []DBRPMapping{{Database: "loggers", Bucket: "sensors"}}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	tests := []struct {
+		target string
+		code   int
+		bucket string
+	}{
+		{target: "/write?db=loggers&rp=one_week&precision=s&u=user&p=secret", code: http.StatusNoContent, bucket: "sensors"},
+		{target: "/write?db=telegraf&precision=s&p=secret", code: http.StatusNoContent, bucket: "telegraf/autogen"},
+		{target: "/write?db=unknown&p=secret", code: http.StatusNotFound},
+		{target: "/write?db=loggers&p=wrong", code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := doRequest(s, http.MethodPost, tt.target+"&sync=true", []byte("cpu value=1 1\n"), nil)
+		if w.Code != tt.code {
+			t.Fatalf("%s: code = %d, want %d: %s", tt.target, w.Code, tt.code, w.Body.String())
+		}
+		if tt.bucket != "" && store.buckets[len(store.buckets)-1] != tt.bucket {
+			t.Errorf("%s: bucket = %s, want %s", tt.target, store.buckets[len(store.buckets)-1], tt.bucket)
+		}
+	}
+	if store.points[0].Time().Unix() != 1 {
+		t.Errorf("precision not applied, time = %v", store.points[0].Time())
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		ctype  string
+		code   int
+		stored int
+		line   int
+	}{
+		{
+			name:   "json",
+			body:   `[{"measurement":"cpu","tags":{"host":"a"},"fields":{"value":1.5,"ok":true},"time":1},{"measurement":"cpu","fields":{"msg":"x"},"time":"2022-01-01T00:00:00Z"}]`,
+			ctype:  "application/json",
+			code:   http.StatusNoContent,
+			stored: 2,
+		},
+		{
+			name:   "json invalid element",
+			target: "/api/v2/write?sync=true&partial=true",
+			body:   `[{"measurement":"cpu","fields":{"value":1}},{"measurement":"cpu","fields":{"value":{"a":1}}},{"fields":{"value":1}}]`,
+			ctype:  "application/json",
+			code:   http.StatusBadRequest,
+			stored: 1,
+			line:   2,
+		},
+		{
+			name:   "csv",
+			target: "/api/v2/write?sync=true&precision=s&measurement=cpu&tag_columns=host",
+			body:   "time,host,value,msg\n1,a,1.5,x\n2,b,,y\n",
+			ctype:  "text/csv",
+			code:   http.StatusNoContent,
+			stored: 2,
+		},
+		{
+			name:   "csv invalid row",
+			target: "/api/v2/write?sync=true&measurement=cpu",
+			body:   "time,value\n1,1\nnow,2\n",
+			ctype:  "text/csv; charset=utf-8",
+			code:   http.StatusBadRequest,
+			line:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, store := newTestServer(t, DefaultConfig())
+			defer s.Stop()
+			target := tt.target
+			if target == "" {
+				target = "/api/v2/write?sync=true"
+			}
+			w := doRequest(s, http.MethodPost, target, []byte(tt.body), map[string]string{"Content-Type": tt.ctype})
+			if w.Code != tt.code {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if store.count() != tt.stored {
+				t.Errorf("stored = %d, want %d", store.count(), tt.stored)
+			}
+			if tt.line > 0 {
+				var reply writeError
+				if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+					t.Fatal(err)
+				}
+				if reply.Line != tt.line {
+					t.Errorf("line = %d, want %d: %s", reply.Line, tt.line, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	conf := DefaultConfig()
+	conf.WAL.Dir = t.TempDir()
+	conf.WAL.Fsync = wal.FsyncAlways
+
+	// points acknowledged but never processed by the last run
+	s := NewServer(conf)
+	s.storage = &memoryStorage{}
+	s.registerRoutes()
+	log, err := wal.Open(conf.WAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal = log
+	w := doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=1 1\ncpu value=2 2\n"), nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	log.Close()
+
+	s, store := newTestServer(t, conf)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.count() != 2 {
+		t.Fatalf("stored = %d, want 2", store.count())
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := os.ReadDir(conf.WAL.Dir)
+	if len(files) != 0 {
+		t.Errorf("%d wal segments left after all points stored", len(files))
+	}
+}
+
+func TestWALConfirm(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		failing = true
+		written int
+	)
+	startInflux(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		written++
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	conf := DefaultConfig()
+	conf.WAL.Dir = t.TempDir()
+	conf.WAL.Fsync = wal.FsyncAlways
+	conf.Storage.MaxRetries = 0
+	start := func() *server {
+		s, _ := newTestServer(t, conf, func(s *server) {
+			s.storage = newInfluxStorage(conf.Storage, nil, s.stats, nil, conf.Buffer, s.walDone)
+		})
+		return s
+	}
+
+	// the client sends a failed synchronous write again, the wal never keeps it
+	s := start()
+	if w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("cpu value=2 2\n"), nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(conf.WAL.Dir); len(files) != 0 {
+		t.Fatalf("%d wal segments left by a failed synchronous write", len(files))
+	}
+
+	// the batch dropped by storage keeps the wal
+	s = start()
+	if w := doRequest(s, http.MethodPost, "/api/v2/write", []byte("cpu value=1 1\n"), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(conf.WAL.Dir); len(files) != 1 {
+		t.Fatalf("%d wal segments left, want 1 of unconfirmed points", len(files))
+	}
+
+	// replayed and removed once influxdb confirmed the points
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	s = start()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if written != 1 || s.stats.snapshot()["points_stored"] != 1 {
+		t.Errorf("written = %d, stats = %v", written, s.stats.snapshot())
+	}
+	if files, _ := os.ReadDir(conf.WAL.Dir); len(files) != 0 {
+		t.Errorf("%d wal segments left after all points stored", len(files))
+	}
+}
+
+type memoryKeys map[string]string
+
+func (m memoryKeys) project(key string) (string, bool) {
+	project, ok := m[key]
+	return project, ok
+}
+
+func (m memoryKeys) close() {}
+
+func TestAPIKeys(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DBRP = []DBRPMapping{{Database: "sensors", Bucket: "default"}}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+	s.keys = memoryKeys{"key-a": "1"}
+
+	tests := []struct {
+		target string
+		token  string
+		code   int
+	}{
+		{target: "/api/v2/write?sync=true", token: "Token unknown", code: http.StatusUnauthorized},
+		{target: "/api/v2/write?sync=true", code: http.StatusUnauthorized},
+		{target: "/api/v2/write?sync=true", token: "Token key-a", code: http.StatusNoContent},
+		{target: "/write?db=sensors&sync=true&p=key-a", code: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		body := []byte("cpu,project_id=2,host=a value=1 1\n")
+		w := doRequest(s, http.MethodPost, tt.target, body, map[string]string{"Authorization": tt.token})
+		if w.Code != tt.code {
+			t.Fatalf("%s %s: code = %d, want %d", tt.target, tt.token, w.Code, tt.code)
+		}
+	}
+	if store.count() != 2 {
+		t.Fatalf("stored = %d, want 2", store.count())
+	}
+	for _, p := range store.points {
+		if p.Tags().GetString(projectTagKey) != "1" || p.Tags().Len() != 2 {
+			t.Errorf("project tag not forced: %s", p.String())
+		}
+	}
+}
+
+func testRegistry(t *testing.T) *registry {
+	r, err := newRegistry(func() (*registryData, error) {
+		return &registryData{
+			sensors: map[string]models.SensorLocation{
+				"00aa": {SensorMac: "00aa", ProjectId: 1, TypeId: 3, Location1Id: 1, Location2Id: 2},
+			},
+			gatherTypes: map[int]map[int]models.SensorGatherType{
+				3: {1: {SensorTypeId: 3, ReceiveNumber: 1, GatherType: "temperature", Unit: "°C"}},
+			},
+		}, nil
+	}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRegistryValidation(t *testing.T) {
+	body := []byte("cpu,sensor_mac=00aa,receive_no=1 value=1 1\ncpu,sensor_mac=00aa,receive_no=2 value=1 1\ncpu,sensor_mac=00bb value=1 1\ncpu value=1 1\n")
+	tests := []struct {
+		mode   string
+		code   int
+		stored int
+		check  func(p models.Point) bool
+	}{
+		{mode: RegistryReject, code: http.StatusBadRequest, stored: 2, check: func(p models.Point) bool {
+			return p.Tags().GetString("receive_no") != "2"
+		}},
+		{mode: RegistryTag, code: http.StatusNoContent, stored: 4, check: func(p models.Point) bool {
+			registered := p.Tags().GetString("receive_no") == "1" || p.Tags().GetString("sensor_mac") == ""
+			return registered == (p.Tags().GetString("unregistered") == "")
+		}},
+		{mode: RegistryQuarantine, code: http.StatusNoContent, stored: 4, check: func(p models.Point) bool {
+			if string(p.Name()) == "quarantine" {
+				return p.Tags().GetString("original_measurement") == "cpu"
+			}
+			return true
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.PartialWrites = true
+			conf.Registry.Mode = tt.mode
+			s, store := newTestServer(t, conf, func(s *server) {
+				s.registry = testRegistry(t)
+			})
+			defer s.Stop()
+
+			w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body, nil)
+			if w.Code != tt.code {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if store.count() != tt.stored {
+				t.Fatalf("stored = %d, want %d", store.count(), tt.stored)
+			}
+			for _, p := range store.points {
+				if !tt.check(p) {
+					t.Errorf("unexpected point %s", p.String())
+				}
+			}
+			if unknown := s.registry.unknownSensors(); len(unknown) != 2 {
+				t.Errorf("unknown sensors = %v, want 2", unknown)
+			}
+		})
+	}
+}
+
+func TestRegistryForeignProject(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Registry.Mode = RegistryTag
+	conf.Registry.Enrich = true
+	s, store := newTestServer(t, conf, func(s *server) {
+		s.registry = testRegistry(t)
+	})
+	defer s.Stop()
+	// sensor 00aa is registered in project 1
+	s.keys = memoryKeys{"key-a": "1", "key-b": "2"}
+
+	body := []byte("cpu,sensor_mac=00aa,receive_no=1 value=1 1\n")
+	for _, key := range []string{"key-a", "key-b"} {
+		w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body, map[string]string{"Authorization": "Token " + key})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s: code = %d, want %d: %s", key, w.Code, http.StatusNoContent, w.Body.String())
+		}
+	}
+	if store.count() != 2 {
+		t.Fatalf("stored = %d, want 2", store.count())
+	}
+	want := []string{
+		"cpu,gather_type=temperature,location_1_id=1,location_2_id=2,project_id=1,receive_no=1,sensor_mac=00aa,sensor_type=3 value=1 1",
+		"cpu,project_id=2,receive_no=1,sensor_mac=00aa,unregistered=true value=1 1",
+	}
+	for i, p := range store.points {
+		if got := p.String(); got != want[i] {
+			t.Errorf("point %d = %s, want %s", i, got, want[i])
+		}
+	}
+	if unknown := s.registry.unknownSensors(); len(unknown) != 1 {
+		t.Errorf("unknown sensors = %v, want 1", unknown)
+	}
+}
+
+func TestEnrichment(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Registry.Enrich = true
+	s, store := newTestServer(t, conf, func(s *server) {
+		s.registry = testRegistry(t)
+		s.registry.data.sensorTypes = map[int]models.SensorType{3: {ID: 3, TypeName: "thermometer"}}
+		s.registry.data.locations = map[locationKey]models.SiteLocationName{
+			{project: 1, ids: [4]int{1, 2}}: {ProjectId: 1, Location1Id: 1, Location2Id: 2, LocationName: "room 2"},
+		}
+	})
+	defer s.Stop()
+
+	body := []byte("cpu,sensor_mac=00aa,receive_no=1,location_1_id=9 value=1 1\ncpu,sensor_mac=00bb value=1 1\n")
+	w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	if store.count() != 2 {
+		t.Fatalf("stored = %d, want 2", store.count())
+	}
+	want := "cpu,gather_type=temperature,location_1_id=1,location_2_id=2,location_name=room\\ 2,project_id=1,receive_no=1,sensor_mac=00aa,sensor_type=3,sensor_type_name=thermometer value=1 1"
+	if got := store.points[0].String(); got != want {
+		t.Errorf("enriched point = %s, want %s", got, want)
+	}
+	if got := store.points[1].String(); got != "cpu,sensor_mac=00bb value=1 1" {
+		t.Errorf("unknown sensor enriched: %s", got)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	rules := `
+rules:
+  - match:
+      measurement: acme
+    rename_measurement: env
+    rename_tags: {dev: mac, mac: sensor_mac, ch: receive_no}
+    rename_fields: {t: value}
+    drop_fields: [rssi]
+    add_tags: {vendor: acme}
+    scale:
+      - unit: "°C"
+        fields: [value]
+        factor: 0.1
+    round: 1s
+`
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.Transform.File = path
+	conf.Registry.Enrich = true
+	s, store := newTestServer(t, conf, func(s *server) {
+		s.registry = testRegistry(t)
+	})
+	defer s.Stop()
+
+	body := []byte("acme,dev=00aa,ch=1 t=215,rssi=-70i 1500000000\nother value=1 1\n")
+	w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	want := "env,gather_type=temperature,location_1_id=1,location_2_id=2,project_id=1,receive_no=1,sensor_mac=00aa,sensor_type=3,vendor=acme value=21.5 2000000000"
+	if got := store.points[0].String(); got != want {
+		t.Errorf("transformed point = %s, want %s", got, want)
+	}
+	if got := store.points[1].String(); got != "other value=1 1" {
+		t.Errorf("point not matched is transformed: %s", got)
+	}
+
+	// invalid rules are ignored on reload, valid ones replace the current rules
+	os.WriteFile(path, []byte("rules:\n  - scale: [{unit: x}]\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := s.transform.reload(); err == nil {
+		t.Errorf("invalid rules reloaded")
+	}
+	os.WriteFile(path, []byte("rules:\n  - add_tags: {site: a}\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err := s.transform.reload(); err != nil {
+		t.Fatal(err)
+	}
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("other value=1 1\n"), nil)
+	if got := store.points[2].String(); got != "other,site=a value=1 1" {
+		t.Errorf("rules not reloaded: %s", got)
+	}
+
+	// integer fields stay integers, or rejected if they could not be scaled exactly
+	os.WriteFile(path, []byte("rules:\n  - scale: [{unit: \"°C\", factor: 10, offset: 1}]\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(3*time.Second))
+	if err := s.transform.reload(); err != nil {
+		t.Fatal(err)
+	}
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("env,sensor_mac=00aa,receive_no=1 value=2i,count=2u,ratio=0.5 1\n"), nil)
+	if got := store.points[3].String(); !strings.HasSuffix(got, " count=21u,ratio=6,value=21i 1") {
+		t.Errorf("integer fields scaled to %s", got)
+	}
+	os.WriteFile(path, []byte("rules:\n  - scale: [{unit: \"°C\", factor: 0.1}]\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(4*time.Second))
+	if err := s.transform.reload(); err != nil {
+		t.Fatal(err)
+	}
+	w = doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("env,sensor_mac=00aa,receive_no=1 value=2i 1\n"), nil)
+	if w.Code != http.StatusBadRequest || store.count() != 4 {
+		t.Errorf("code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// units are unknown without the registry
+	if _, err := newTransformStage(conf.Transform, nil); err == nil {
+		t.Errorf("scale rules loaded without registry")
+	}
+}
+
+func TestRenames(t *testing.T) {
+	var rules TransformRules
+	if err := yaml.UnmarshalStrict([]byte("rules:\n  - rename_tags: {b: c, a: b, 1: one}\n"), &rules); err != nil {
+		t.Fatal(err)
+	}
+	want := Renames{{From: "b", To: "c"}, {From: "a", To: "b"}, {From: "1", To: "one"}}
+	if got := rules.Rules[0].RenameTags; !reflect.DeepEqual(got, want) {
+		t.Fatalf("renames = %v, want %v", got, want)
+	}
+	// applied in the order written, a is renamed to b but not to c
+	tr := &transformStage{}
+	p, _ := models.NewPoint("cpu", models.NewTags(map[string]string{"a": "1", "b": "2"}), models.Fields{"value": 1.0}, time.Unix(1, 0))
+	p, err := tr.transform(&rules.Rules[0], p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != "cpu,b=1,c=2 value=1 1000000000" {
+		t.Errorf("renamed point = %s", got)
+	}
+
+	invalid := []string{
+		"rules:\n  - rename_tags: [a, b]\n",
+		"rules:\n  - rename_fields: {a: }\n",
+		// the project tag forced by api keys is never changed by rules
+		"rules:\n  - rename_tags: {site: project_id}\n",
+		"rules:\n  - rename_tags: {project_id: site}\n",
+		"rules:\n  - add_tags: {project_id: 2}\n",
+	}
+	for _, content := range invalid {
+		var rules TransformRules
+		err := yaml.UnmarshalStrict([]byte(content), &rules)
+		if err == nil {
+			err = rules.Validate()
+		}
+		if err == nil {
+			t.Errorf("invalid renames accepted: %s", content)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Dedup = DedupConfig{Enabled: true, Window: time.Minute, MaxEntries: 2}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	body := []byte("cpu,sensor_mac=00aa value=1 1\ncpu,sensor_mac=00aa value=1 1\ncpu,sensor_mac=00aa value=1 2\n")
+	w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("code = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	if store.count() != 2 {
+		t.Fatalf("stored = %d, want 2", store.count())
+	}
+
+	// the first point is forgotten when the third one is remembered
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("cpu,sensor_mac=00aa value=1 3\ncpu,sensor_mac=00aa value=1 1\n"), nil)
+	if store.count() != 4 {
+		t.Fatalf("stored = %d, want 4", store.count())
+	}
+	status := s.dedup.status()
+	if status["duplicates"] != uint64(1) {
+		t.Errorf("unexpected status %v", status)
+	}
+	if sensors := status["sensors"].([]sensorDuplicates); len(sensors) != 1 || sensors[0].Duplicates != 1 {
+		t.Errorf("unexpected duplicates of sensors %v", sensors)
+	}
+
+	// points of failed requests are forgotten, so the retries are stored
+	conf.Dedup.MaxEntries = 5000
+	s, store = newTestServer(t, conf)
+	defer s.Stop()
+	valid := []byte("cpu,sensor_mac=00aa value=1 1\n")
+	if w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", append(valid, "cpu value=\n"...), nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	// the lines read before the body exceeds the limit are forgotten as well
+	var large bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&large, "cpu,sensor_mac=00cc value=1 %d\n", i)
+	}
+	s.conf.MaxBodySize = int64(large.Len()) - 1
+	if w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", large.Bytes(), nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	s.conf.MaxBodySize = 0
+	if w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", large.Bytes(), nil); w.Code != http.StatusNoContent || store.count() != 200 {
+		t.Fatalf("code = %d, stored = %d, want %d and 200", w.Code, store.count(), http.StatusNoContent)
+	}
+	store.err = errors.New("influxdb unavailable")
+	if w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", valid, nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("code = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	store.err = nil
+	if w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", valid, nil); w.Code != http.StatusNoContent || store.count() != 201 {
+		t.Fatalf("code = %d, stored = %d, want %d and 201", w.Code, store.count(), http.StatusNoContent)
+	}
+
+	// the ring grows when needed, up to max entries
+	if len(s.dedup.ring) != dedupInitialEntries {
+		t.Fatalf("ring of %d entries, want %d", len(s.dedup.ring), dedupInitialEntries)
+	}
+	var many bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&many, "cpu,sensor_mac=00bb value=1 %d\n", i)
+	}
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", many.Bytes(), nil)
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", many.Bytes(), nil)
+	if len(s.dedup.ring) != 4096 || store.count() != 3201 {
+		t.Errorf("ring of %d entries, stored = %d, want 4096 and 3201", len(s.dedup.ring), store.count())
+	}
+}
+
+func TestTimePolicy(t *testing.T) {
+	now := time.Now().UTC()
+	body := []byte(fmt.Sprintf("cpu,sensor_mac=00aa value=1 %d\ncpu,sensor_mac=00bb value=1 1\ncpu,sensor_mac=00cc value=1 %d\n",
+		now.UnixNano(), now.Add(48*time.Hour).UnixNano()))
+	tests := []struct {
+		action string
+		code   int
+		stored int
+		check  func(store *memoryStorage) bool
+	}{
+		{action: TimeReject, code: http.StatusBadRequest, stored: 1},
+		{action: TimeClamp, code: http.StatusNoContent, stored: 3, check: func(store *memoryStorage) bool {
+			return store.points[1].Time().After(now.Add(-time.Minute)) && store.points[2].Time().Before(now.Add(time.Minute))
+		}},
+		{action: TimeQuarantine, code: http.StatusNoContent, stored: 3, check: func(store *memoryStorage) bool {
+			return store.buckets[0] == "default" && store.buckets[1] == "late" && store.buckets[2] == "late"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.PartialWrites = true
+			conf.Workers = 1
+			conf.Buckets = []string{"late"}
+			conf.TimePolicy = TimePolicyConfig{MaxAge: 24 * time.Hour, MaxFuture: time.Hour, Action: tt.action, QuarantineBucket: "late"}
+			s, store := newTestServer(t, conf)
+			defer s.Stop()
+
+			w := doRequest(s, http.MethodPost, "/api/v2/write?sync=true", body, nil)
+			if w.Code != tt.code {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if store.count() != tt.stored {
+				t.Fatalf("stored = %d, want %d", store.count(), tt.stored)
+			}
+			if tt.check != nil && !tt.check(store) {
+				t.Errorf("unexpected points %v in buckets %v", store.points, store.buckets)
+			}
+			violations := s.timePolicy.violations()
+			if len(violations) != 2 {
+				t.Fatalf("violations = %v, want 2", violations)
+			}
+			for _, v := range violations {
+				if (v.Device == "00bb" && v.Late != 1) || (v.Device == "00cc" && v.Future != 1) {
+					t.Errorf("unexpected violation %+v", v)
+				}
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	conf := DefaultConfig()
+	conf.PartialWrites = true
+	s, _ := newTestServer(t, conf)
+	defer s.Stop()
+	s.keys = memoryKeys{"key-a": "1"}
+
+	auth := map[string]string{"Authorization": "Token key-a"}
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte("cpu value=1 1\ncpu value=\ncpu value=2 2\n"), auth)
+	auth["Content-Type"] = "application/json"
+	doRequest(s, http.MethodPost, "/api/v2/write?sync=true", []byte(`[{"measurement":"cpu","fields":{"value":1}}]`), auth)
+
+	w := doRequest(s, http.MethodGet, "/metrics", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %d", w.Code)
+	}
+	for _, want := range []string{
+		`gateway_points_received_total{format="line",project="1",source="http"} 3`,
+		`gateway_points_parsed_total{format="line",project="1",source="http"} 2`,
+		`gateway_points_rejected_total{format="line",project="1",source="http"} 1`,
+		`gateway_points_parsed_total{format="json",project="1",source="http"} 1`,
+		`gateway_points_queued_total 3`,
+		`gateway_queue_depth 0`,
+		`gateway_http_request_duration_seconds_count{code="400",method="POST",route="/api/v2/write"} 1`,
+		`gateway_http_request_duration_seconds_count{code="204",method="POST",route="/api/v2/write"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metric %s not found", want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"timeseries/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// max size of an udp packet
+const maxPacketSize = 64 * 1024
+
+// max length of a tcp line, longer lines are discarded
+const maxLineSize = 64 * 1024
+
+// ListenerConfig : raw socket listener receiving line protocol, like the udp
+// service of influxdb and the socket_writer output of telegraf
+type ListenerConfig struct {
+	Protocol  string `yaml:"protocol"`  // udp or tcp
+	Address   string `yaml:"address"`   // e.g. :8089
+	Precision string `yaml:"precision"` // ns when empty
+	Bucket    string `yaml:"bucket"`    // default bucket when empty
+}
+
+func (c ListenerConfig) Validate() error {
+	if c.Protocol != "udp" && c.Protocol != "tcp" {
+		return fmt.Errorf("gateway: unsupported listener protocol %q", c.Protocol)
+	}
+	if c.Address == "" {
+		return fmt.Errorf("gateway: address of %s listener could not be empty", c.Protocol)
+	}
+	if c.Precision != "" && !models.ValidPrecision(c.Precision) {
+		return fmt.Errorf("gateway: invalid precision %q of %s listener %s", c.Precision, c.Protocol, c.Address)
+	}
+	return nil
+}
+
+// listenerStatus : counters of a listener, fields must be accessed atomically
+type listenerStatus struct {
+	Protocol  string `json:"protocol"`
+	Address   string `json:"address"`
+	Packets   uint64 `json:"packets"`   // udp packets or tcp lines received
+	Points    uint64 `json:"points"`    // points queued
+	Malformed uint64 `json:"malformed"` // lines could not be parsed
+	Dropped   uint64 `json:"dropped"`   // points dropped because the queue is full
+}
+
+// socketListener receives line protocol from an udp or tcp socket and queues the points.
+// Senders get no reply, so invalid or dropped points are only counted and logged.
+type socketListener struct {
+	server *server
+	conf   ListenerConfig
+	bucket string
+	status listenerStatus
+
+	packetConn net.PacketConn // udp
+	listener   net.Listener   // tcp
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // open tcp connections
+	closed bool                  // no more connections are handled
+	wg     sync.WaitGroup
+}
+
+func newSocketListener(s *server, conf ListenerConfig) (*socketListener, error) {
+	bucket, ok := s.resolveBucket(conf.Bucket)
+	if !ok {
+		return nil, fmt.Errorf("gateway: bucket %q of %s listener %s not found", conf.Bucket, conf.Protocol, conf.Address)
+	}
+	if conf.Precision == "" {
+		conf.Precision = "ns"
+	}
+	return &socketListener{
+		server: s,
+		conf:   conf,
+		bucket: bucket,
+		status: listenerStatus{Protocol: conf.Protocol, Address: conf.Address},
+		conns:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// start binds the socket and begins to receive in background
+func (l *socketListener) start() error {
+	var err error
+	if l.conf.Protocol == "udp" {
+		l.packetConn, err = net.ListenPacket("udp", l.conf.Address)
+		if err != nil {
+			return fmt.Errorf("gateway: listen udp %s failed: %s", l.conf.Address, err.Error())
+		}
+		l.wg.Add(1)
+		go l.serveUDP()
+	} else {
+		l.listener, err = net.Listen("tcp", l.conf.Address)
+		if err != nil {
+			return fmt.Errorf("gateway: listen tcp %s failed: %s", l.conf.Address, err.Error())
+		}
+		l.wg.Add(1)
+		go l.serveTCP()
+	}
+	logrus.Infof("%s listener on %s started", l.conf.Protocol, l.addr())
+	return nil
+}
+
+// addr returns the address bound by the listener
+func (l *socketListener) addr() net.Addr {
+	if l.packetConn != nil {
+		return l.packetConn.LocalAddr()
+	}
+	return l.listener.Addr()
+}
+
+// stop closes the socket and the open connections, then waits for the points
+// being received to be queued
+func (l *socketListener) stop() {
+	if l.packetConn != nil {
+		l.packetConn.Close()
+	}
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	l.mu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+}
+
+// snapshot returns a copy of the counters
+func (l *socketListener) snapshot() listenerStatus {
+	return listenerStatus{
+		Protocol:  l.status.Protocol,
+		Address:   l.status.Address,
+		Packets:   atomic.LoadUint64(&l.status.Packets),
+		Points:    atomic.LoadUint64(&l.status.Points),
+		Malformed: atomic.LoadUint64(&l.status.Malformed),
+		Dropped:   atomic.LoadUint64(&l.status.Dropped),
+	}
+}
+
+// serveUDP handles every packet as a batch of lines
+func (l *socketListener) serveUDP() {
+	defer l.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.packetConn.ReadFrom(buf)
+		if err != nil {
+			if !isClosedError(err) {
+				logrus.Errorf("read udp %s failed: %s", l.conf.Address, err.Error())
+			}
+			return
+		}
+		// points refer to the packet, so the buffer is not reused for them
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		l.receive(packet)
+	}
+}
+
+// serveTCP accepts connections, each of them sends lines separated by newlines
+func (l *socketListener) serveTCP() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !isClosedError(err) {
+				logrus.Errorf("accept tcp %s failed: %s", l.conf.Address, err.Error())
+			}
+			return
+		}
+		l.mu.Lock()
+		if l.closed {
+			// accepted while stopping
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+
+		go l.handleConn(conn)
+	}
+}
+
+func (l *socketListener) handleConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+	}()
+
+	// lines are framed by newlines only and limited in length, so a broken line
+	// never takes the rest of the stream
+	reader := bufio.NewReaderSize(conn, maxLineSize)
+	var (
+		points    []models.Point
+		lines     int
+		malformed int
+		discarded bool // the rest of a line longer than max line size is read
+	)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !discarded {
+				discarded = true
+				lines++
+				malformed++
+				logrus.Debugf("discard line longer than %d bytes from %s", maxLineSize, conn.RemoteAddr())
+			}
+			continue
+		}
+		if discarded {
+			discarded = false
+		} else if len(line) > 0 {
+			lines++
+			// points refer to the line, which is overwritten by the next read
+			parsed, parseErr := models.ParsePointsWithPrecision(append([]byte(nil), line...), time.Now().UTC(), l.conf.Precision)
+			points = append(points, parsed...)
+			if parseErr != nil {
+				malformed++
+				logrus.Debugf("malformed line protocol from %s listener %s: %s", l.conf.Protocol, l.conf.Address, parseErr.Error())
+			}
+		}
+		// lines already received are queued in one batch
+		if lines > 0 && (err != nil || reader.Buffered() == 0 || lines >= l.server.chunkSize()) {
+			l.queue(points, lines, malformed)
+			points, lines, malformed = nil, 0, 0
+		}
+		if err != nil {
+			if err != io.EOF && !isClosedError(err) {
+				logrus.Warnf("read tcp connection from %s failed: %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+	}
+}
+
+// receive parses the lines of an udp packet and queues the valid points
+func (l *socketListener) receive(packet []byte) {
+	points, malformed, err := parseLines(packet, l.conf.Precision)
+	if err != nil {
+		logrus.Debugf("malformed line protocol from %s listener %s: %s", l.conf.Protocol, l.conf.Address, err.Error())
+	}
+	l.queue(points, 1, malformed)
+}
+
+// queue counts the points parsed from n packets or lines and queues the valid ones
+func (l *socketListener) queue(points []models.Point, n, malformed int) {
+	atomic.AddUint64(&l.status.Packets, uint64(n))
+	l.server.metrics.pointsParsed(l.conf.Protocol, formatLine, "", len(points))
+	if malformed > 0 {
+		atomic.AddUint64(&l.status.Malformed, uint64(malformed))
+		l.server.metrics.pointsMalformed(l.conf.Protocol, formatLine, "", malformed)
+	}
+	if len(points) == 0 {
+		return
+	}
+
+	entries := make([]entry, 0, len(points))
+	for _, p := range points {
+		e := entry{point: p, bucket: l.bucket}
+		if err := l.server.prepare(&e); err != nil {
+			if err != errDropped {
+				l.server.metrics.pointsRejected(l.conf.Protocol, formatLine, "", 1)
+			}
+			logrus.Debugf("point of %s listener %s rejected: %s", l.conf.Protocol, l.conf.Address, err.Error())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := l.server.enqueue(context.Background(), entries); err != nil {
+		atomic.AddUint64(&l.status.Dropped, uint64(len(entries)))
+		logrus.Errorf("drop %d points of %s listener %s: %s", len(entries), l.conf.Protocol, l.conf.Address, err.Error())
+		return
+	}
+	atomic.AddUint64(&l.status.Points, uint64(len(entries)))
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
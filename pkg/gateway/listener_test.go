@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketListeners(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Listeners = []ListenerConfig{
+		{Protocol: "udp", Address: "127.0.0.1:0", Precision: "s"},
+		{Protocol: "tcp", Address: "127.0.0.1:0"},
+	}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	udp, err := net.Dial("udp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte("cpu,host=a value=1 1\ncpu,host=b value=2 2\n"))
+	udp.Write([]byte("cpu,host=a value=\n"))
+	// each failed line is counted once, even when its error spans lines
+	udp.Write([]byte("cpu,host=c value=3 2\ncpu msg=\"a\nb\",value= 3\ncpu,host=d\n"))
+
+	tcp, err := net.Dial("tcp", s.listeners[1].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp.Write([]byte("mem,host=a used=1 1\nmem,host=a\nmem,host=b used=2 2\n"))
+	tcp.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.count() < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.count() != 5 {
+		t.Fatalf("stored = %d, want 5", store.count())
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for s.listeners[1].snapshot().Packets < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	udpStatus, tcpStatus := s.listeners[0].snapshot(), s.listeners[1].snapshot()
+	if udpStatus.Packets != 3 || udpStatus.Points != 3 || udpStatus.Malformed != 3 {
+		t.Errorf("unexpected udp status %+v", udpStatus)
+	}
+	if tcpStatus.Packets != 3 || tcpStatus.Points != 2 || tcpStatus.Malformed != 1 {
+		t.Errorf("unexpected tcp status %+v", tcpStatus)
+	}
+	for _, p := range store.points {
+		if string(p.Name()) == "cpu" && p.Time().Unix() > 2 {
+			t.Errorf("precision not applied, time = %v", p.Time())
+		}
+	}
+}
+
+func TestTCPLineFraming(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Listeners = []ListenerConfig{{Protocol: "tcp", Address: "127.0.0.1:0"}}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	tcp, err := net.Dial("tcp", s.listeners[0].addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	// an unbalanced quote and a line over the max size never take the lines after them
+	var body bytes.Buffer
+	body.WriteString("log,host=a msg=\"broken 1\n")
+	body.WriteString("log,host=a msg=\"" + strings.Repeat("x", 2*maxLineSize) + "\" 2\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&body, "cpu,host=a value=%d %d\n", i, i+3)
+	}
+	if _, err := tcp.Write(body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.count() < 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.count() != 100 {
+		t.Fatalf("stored = %d, want 100", store.count())
+	}
+	if st := s.listeners[0].snapshot(); st.Packets != 102 || st.Malformed != 2 || st.Points != 100 {
+		t.Errorf("unexpected tcp status %+v", st)
+	}
+}
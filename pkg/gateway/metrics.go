@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sources of points, label of the point metrics
+const (
+	sourceHTTP = "http"
+	sourceMQTT = "mqtt"
+)
+
+// formats of points, label of the point metrics
+const (
+	formatLine = "line"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// timeout of influxdb write requests, the same as the default of the client
+const storageRequestTimeout = 20 * time.Second
+
+// metrics : prometheus collectors of the gateway, exposed on /metrics.
+// Each server has its own registry, so more than one server could run in a process.
+//
+// Points are counted by source, format and project. The project is the one of the
+// api key, empty for sources without api keys, tags of points are never used as
+// labels to keep the number of series bounded.
+type metrics struct {
+	registry *prometheus.Registry
+
+	// points read from the sources, including malformed ones
+	received *prometheus.CounterVec
+	// points parsed successfully
+	parsed *prometheus.CounterVec
+	// points malformed or rejected by the pipeline stages
+	rejected *prometheus.CounterVec
+	// latency of write requests to influxdb, by status code
+	storageLatency *prometheus.HistogramVec
+	// latency of http requests, by method, route and status code
+	requestLatency *prometheus.HistogramVec
+}
+
+func newMetrics(st *stats, queues []chan entry) *metrics {
+	pointLabels := []string{"source", "format", "project"}
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_points_received_total",
+			Help: "Points read from the sources, including malformed ones.",
+		}, pointLabels),
+		parsed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_points_parsed_total",
+			Help: "Points parsed successfully.",
+		}, pointLabels),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_points_rejected_total",
+			Help: "Points malformed or rejected by the pipeline stages.",
+		}, pointLabels),
+		storageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_storage_write_duration_seconds",
+			Help:    "Latency of write requests to influxdb.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code"}),
+		requestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_http_request_duration_seconds",
+			Help:    "Latency of http requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+	}
+
+	counter := func(name, help string, v *uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			return float64(atomic.LoadUint64(v))
+		})
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.received,
+		m.parsed,
+		m.rejected,
+		m.storageLatency,
+		m.requestLatency,
+		counter("gateway_points_queued_total", "Points accepted into the process queues.", &st.received),
+		counter("gateway_points_dropped_total", "Points dropped by the pipeline stages, e.g. duplicates.", &st.dropped),
+		counter("gateway_points_lost_total", "Points still queued when the server stopped.", &st.lost),
+		counter("gateway_points_stored_total", "Points confirmed by influxdb.", &st.stored),
+		counter("gateway_storage_errors_total", "Write requests to influxdb failed.", &st.storeErrors),
+		counter("gateway_points_published_total", "Points delivered to the publisher.", &st.published),
+		counter("gateway_publish_errors_total", "Points failed to publish.", &st.pubErrors),
+		counter("gateway_batches_buffered_total", "Failed batches saved into the disk buffer.", &st.buffered),
+		counter("gateway_batches_forwarded_total", "Buffered batches written into influxdb.", &st.forwarded),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_queue_depth",
+			Help: "Points waiting in the process queues.",
+		}, func() float64 {
+			depth := 0
+			for _, queue := range queues {
+				depth += len(queue)
+			}
+			return float64(depth)
+		}),
+	)
+	return m
+}
+
+// pointsParsed counts points read and parsed successfully
+func (m *metrics) pointsParsed(source, format, project string, n int) {
+	m.received.WithLabelValues(source, format, project).Add(float64(n))
+	m.parsed.WithLabelValues(source, format, project).Add(float64(n))
+}
+
+// pointsMalformed counts points read but could not be parsed
+func (m *metrics) pointsMalformed(source, format, project string, n int) {
+	m.received.WithLabelValues(source, format, project).Add(float64(n))
+	m.rejected.WithLabelValues(source, format, project).Add(float64(n))
+}
+
+// pointsRejected counts parsed points rejected by the pipeline stages
+func (m *metrics) pointsRejected(source, format, project string, n int) {
+	m.rejected.WithLabelValues(source, format, project).Add(float64(n))
+}
+
+// handler serves the metrics in the prometheus text format
+func (m *metrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// instrument is the middleware observing the latency of http requests
+func (m *metrics) instrument(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requestLatency.WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+// storageClient returns the http client of the influxdb writer, which observes the
+// latency of write requests
+func (m *metrics) storageClient() *http.Client {
+	return &http.Client{
+		Timeout:   storageRequestTimeout,
+		Transport: &observedTransport{next: http.DefaultTransport, latency: m.storageLatency},
+	}
+}
+
+// observedTransport observes the latency of write requests, labeled by the status
+// code, "error" when no response received
+type observedTransport struct {
+	next    http.RoundTripper
+	latency *prometheus.HistogramVec
+}
+
+func (t *observedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/write") {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.latency.WithLabelValues(code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"timeseries/pkg/models"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// payload formats of mqtt messages
+const (
+	PayloadLine = "line" // line protocol, one point a line
+	PayloadJSON = "json" // a point object or an array of point objects, the same as json writes
+)
+
+// MQTTConfig : mqtt ingestion source, disabled when broker is empty
+type MQTTConfig struct {
+	Broker   string      `yaml:"broker"` // e.g. tcp://localhost:1883
+	ClientID string      `yaml:"client_id"`
+	Username string      `yaml:"username"`
+	Password string      `yaml:"password"`
+	QoS      byte        `yaml:"qos"`
+	Topics   []MQTTTopic `yaml:"topics"`
+}
+
+// MQTTTopic : a subscribed topic pattern and how its messages are converted to points
+type MQTTTopic struct {
+	// topic filter to subscribe, could contain + and # wildcards
+	Pattern string `yaml:"pattern"`
+	Format  string `yaml:"format"` // line when empty
+	// 1-based index of the topic level holding sensor mac and receive number,
+	// added as tags of all points in the message. 0 means not in topic.
+	SensorMacSegment int    `yaml:"sensor_mac_segment"`
+	ReceiveNoSegment int    `yaml:"receive_no_segment"`
+	Bucket           string `yaml:"bucket"`    // default bucket when empty
+	Precision        string `yaml:"precision"` // ns when empty
+}
+
+func (c MQTTConfig) Validate() error {
+	if c.Broker == "" {
+		return nil
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("gateway: invalid mqtt qos %d", c.QoS)
+	}
+	if len(c.Topics) == 0 {
+		return fmt.Errorf("gateway: no mqtt topic to subscribe")
+	}
+	for _, t := range c.Topics {
+		if t.Pattern == "" {
+			return fmt.Errorf("gateway: mqtt topic pattern could not be empty")
+		}
+		if t.Format != "" && t.Format != PayloadLine && t.Format != PayloadJSON {
+			return fmt.Errorf("gateway: unsupported payload format %q of mqtt topic %s", t.Format, t.Pattern)
+		}
+		if t.SensorMacSegment < 0 || t.ReceiveNoSegment < 0 {
+			return fmt.Errorf("gateway: invalid topic segment of mqtt topic %s", t.Pattern)
+		}
+		if t.Precision != "" && !models.ValidPrecision(t.Precision) {
+			return fmt.Errorf("gateway: invalid precision %q of mqtt topic %s", t.Precision, t.Pattern)
+		}
+	}
+	return nil
+}
+
+// mqttSource subscribes the configured topics and queues the points of messages
+type mqttSource struct {
+	server *server
+	conf   MQTTConfig
+	client mqtt.Client
+}
+
+func newMQTTSource(s *server, conf MQTTConfig) (*mqttSource, error) {
+	conf.Topics = append([]MQTTTopic(nil), conf.Topics...)
+	for i, t := range conf.Topics {
+		bucket, ok := s.resolveBucket(t.Bucket)
+		if !ok {
+			return nil, fmt.Errorf("gateway: bucket %q of mqtt topic %s not found", t.Bucket, t.Pattern)
+		}
+		conf.Topics[i].Bucket = bucket
+		if t.Format == "" {
+			conf.Topics[i].Format = PayloadLine
+		}
+		if t.Precision == "" {
+			conf.Topics[i].Precision = "ns"
+		}
+	}
+	return &mqttSource{server: s, conf: conf}, nil
+}
+
+// start connects to the broker in background, topics are subscribed again on every
+// reconnect. An unreachable broker never blocks the gateway, it is retried until stopped.
+func (m *mqttSource) start() {
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.conf.Broker).
+		SetClientID(m.conf.ClientID).
+		SetUsername(m.conf.Username).
+		SetPassword(m.conf.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(m.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logrus.Warnf("mqtt connection lost: %s", err.Error())
+		})
+	m.client = mqtt.NewClient(opts)
+	// with connect retry the token completes only once connected, or failed when
+	// disconnected before that
+	token := m.client.Connect()
+	go func() {
+		if token.Wait(); token.Error() != nil {
+			logrus.Errorf("connect mqtt broker %s failed: %s", m.conf.Broker, token.Error().Error())
+		}
+	}()
+}
+
+func (m *mqttSource) subscribe(client mqtt.Client) {
+	for i := range m.conf.Topics {
+		topic := m.conf.Topics[i]
+		token := client.Subscribe(topic.Pattern, m.conf.QoS, func(_ mqtt.Client, msg mqtt.Message) {
+			m.handle(topic, msg.Topic(), msg.Payload())
+		})
+		if token.Wait() && token.Error() != nil {
+			logrus.Errorf("subscribe mqtt topic %s failed: %s", topic.Pattern, token.Error().Error())
+			continue
+		}
+		logrus.Infof("mqtt topic %s subscribed", topic.Pattern)
+	}
+}
+
+// stop disconnects from the broker, messages being handled are waited for
+func (m *mqttSource) stop() {
+	if m.client != nil {
+		m.client.Disconnect(250)
+	}
+}
+
+// handle converts a message to points and queues them. Messages could not be
+// replied to, so invalid or dropped points are only counted and logged.
+func (m *mqttSource) handle(topic MQTTTopic, name string, payload []byte) {
+	st := m.server.stats
+	st.add(&st.mqttMessages, 1)
+
+	format := topic.Format
+	points, failed, err := parseMQTTPayload(topic, payload)
+	m.server.metrics.pointsParsed(sourceMQTT, format, "", len(points))
+	if err != nil {
+		st.add(&st.mqttInvalid, 1)
+		m.server.metrics.pointsMalformed(sourceMQTT, format, "", failed)
+		logrus.Warnf("invalid mqtt message of topic %s: %s", name, err.Error())
+		if len(points) == 0 {
+			return
+		}
+	}
+
+	segments := strings.Split(name, "/")
+	entries := make([]entry, 0, len(points))
+	for _, p := range points {
+		if err := setTopicTag(p, segments, topic.SensorMacSegment, "sensor_mac"); err != nil {
+			st.add(&st.mqttInvalid, 1)
+			m.server.metrics.pointsRejected(sourceMQTT, format, "", len(points))
+			logrus.Warnf("invalid mqtt message of topic %s: %s", name, err.Error())
+			return
+		}
+		if err := setTopicTag(p, segments, topic.ReceiveNoSegment, "receive_no"); err != nil {
+			st.add(&st.mqttInvalid, 1)
+			m.server.metrics.pointsRejected(sourceMQTT, format, "", len(points))
+			logrus.Warnf("invalid mqtt message of topic %s: %s", name, err.Error())
+			return
+		}
+		e := entry{point: p, bucket: topic.Bucket}
+		if err := m.server.prepare(&e); err != nil {
+			if err != errDropped {
+				m.server.metrics.pointsRejected(sourceMQTT, format, "", 1)
+			}
+			logrus.Debugf("point of mqtt topic %s rejected: %s", name, err.Error())
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if err := m.server.enqueue(context.Background(), entries); err != nil {
+		st.add(&st.mqttDropped, len(entries))
+		logrus.Errorf("drop %d points of mqtt topic %s: %s", len(entries), name, err.Error())
+	}
+}
+
+// setTopicTag sets the tag to the topic level at the 1-based index
+func setTopicTag(p models.Point, segments []string, index int, key string) error {
+	if index == 0 {
+		return nil
+	}
+	if index > len(segments) || segments[index-1] == "" {
+		return fmt.Errorf("topic level %d of %s not found", index, key)
+	}
+	setTag(p, key, segments[index-1])
+	return nil
+}
+
+// parseMQTTPayload returns the valid points of the payload, with the number and the error
+// of invalid ones
+func parseMQTTPayload(topic MQTTTopic, payload []byte) ([]models.Point, int, error) {
+	if topic.Format == PayloadLine {
+		return parseLines(payload, topic.Precision)
+	}
+
+	// a payload could not be decoded counts as one failed point
+	var inputs []jsonPointInput
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		if err := decodeJSON(payload, &inputs); err != nil {
+			return nil, 1, err
+		}
+	} else {
+		var in jsonPointInput
+		if err := decodeJSON(payload, &in); err != nil {
+			return nil, 1, err
+		}
+		inputs = append(inputs, in)
+	}
+
+	now := time.Now().UTC()
+	points := make([]models.Point, 0, len(inputs))
+	var failed []string
+	for i, in := range inputs {
+		p, err := in.toPoint(topic.Precision, now)
+		if err != nil {
+			failed = append(failed, "point "+strconv.Itoa(i+1)+": "+err.Error())
+			continue
+		}
+		points = append(points, p)
+	}
+	if len(failed) > 0 {
+		return points, len(failed), fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return points, 0, nil
+}
+
+func decodeJSON(payload []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	broker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+// startBroker runs an embedded broker on a free local port
+func startBroker(t *testing.T) (*broker.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	b := broker.NewServer(nil)
+	if err := b.AddListener(listeners.NewTCP("t1", addr), &listeners.Config{Auth: new(auth.Allow)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, "tcp://" + addr
+}
+
+func TestMQTTSource(t *testing.T) {
+	b, addr := startBroker(t)
+
+	conf := DefaultConfig()
+	conf.MQTT.Broker = addr
+	conf.MQTT.Topics = []MQTTTopic{
+		{Pattern: "sensors/+/+/line", SensorMacSegment: 2, ReceiveNoSegment: 3, Precision: "s"},
+		{Pattern: "sensors/+/json", Format: PayloadJSON, SensorMacSegment: 2},
+	}
+	s, store := newTestServer(t, conf)
+	defer s.Stop()
+
+	messages := []struct {
+		topic   string
+		payload string
+	}{
+		{"sensors/00aa/1/line", "temperature value=21.5 1\nhumidity value=\n"},
+		{"sensors/00bb/json", `[{"measurement":"humidity","fields":{"value":40}},{"measurement":"humidity","tags":{"sensor_mac":"ignored"},"fields":{"value":41}}]`},
+	}
+	// retained messages are delivered even if topics are subscribed after published
+	for _, m := range messages {
+		if err := b.Publish(m.topic, []byte(m.payload), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.count() != 3 {
+		t.Fatalf("stored = %d, want 3", store.count())
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, p := range store.points {
+		tags := p.Tags()
+		switch string(p.Name()) {
+		case "temperature":
+			if tags.GetString("sensor_mac") != "00aa" || tags.GetString("receive_no") != "1" || p.Time().Unix() != 1 {
+				t.Errorf("unexpected point %s", p.String())
+			}
+		case "humidity":
+			if tags.GetString("sensor_mac") != "00bb" {
+				t.Errorf("unexpected point %s", p.String())
+			}
+		}
+	}
+	if st := s.stats.snapshot(); st["mqtt_messages"] != 2 || st["mqtt_invalid"] != 1 {
+		t.Errorf("unexpected stats %v", st)
+	}
+}
+
+func TestMQTTUnreachable(t *testing.T) {
+	conf := DefaultConfig()
+	conf.MQTT.Broker = "tcp://127.0.0.1:1"
+	conf.MQTT.Topics = []MQTTTopic{{Pattern: "sensors/#"}}
+
+	// the gateway starts while the broker is retried in background
+	start := time.Now()
+	s, _ := newTestServer(t, conf)
+	if time.Since(start) > time.Second {
+		t.Errorf("init took %s", time.Since(start))
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package gateway
+
+import "errors"
+
+// errDropped is returned by stages dropping a point silently, the sender is not told
+var errDropped = errors.New("point dropped")
+
+// stage validates or transforms a point before it is queued. Stages may change
+// the point and its bucket, an error rejects the point.
+type stage interface {
+	apply(e *entry) error
+}
+
+// prepare runs the stages of the pipeline in order on an entry received by any source
+func (s *server) prepare(e *entry) error {
+	for _, st := range s.stages {
+		if err := st.apply(e); err != nil {
+			if err == errDropped {
+				s.stats.add(&s.stats.dropped, 1)
+			} else {
+				s.stats.add(&s.stats.rejected, 1)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// forget removes the points from the dedup stage, called when they failed to be
+// queued or stored, so the retries are not dropped as duplicates
+func (s *server) forget(entries []entry) {
+	if s.dedup != nil {
+		s.dedup.forget(entries)
+	}
+}
+
+// buildStages returns the stages enabled by the config
+func (s *server) buildStages() []stage {
+	var stages []stage
+	// transformed first, so renamed tags are validated
+	if s.transform != nil {
+		stages = append(stages, s.transform)
+	}
+	if s.timePolicy != nil {
+		stages = append(stages, s.timePolicy)
+	}
+	if s.registry != nil && s.conf.Registry.Mode != RegistryOff {
+		stages = append(stages, &registryStage{registry: s.registry, conf: s.conf.Registry})
+	}
+	if s.registry != nil && s.conf.Registry.Enrich {
+		stages = append(stages, &enrichStage{registry: s.registry})
+	}
+	// the last, points are compared after transformed
+	if s.dedup != nil {
+		stages = append(stages, s.dedup)
+	}
+	return stages
+}
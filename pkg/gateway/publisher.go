@@ -0,0 +1,325 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"timeseries/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PublisherNone = "none"
+	PublisherBus  = "bus"
+	PublisherFile = "file"
+	PublisherDapr = "dapr"
+)
+
+// Publisher delivers the points received by the gateway to downstream consumers,
+// such as the stream detection tasks. Implementations must be safe for concurrent use.
+type Publisher interface {
+	Publish(p models.Point) error
+	Close() error
+}
+
+// PublisherConfig : select the publisher by type, only the config of the selected type is used
+type PublisherConfig struct {
+	Type string              `yaml:"type"` // none, bus, file, dapr
+	File FilePublisherConfig `yaml:"file"`
+	Dapr DaprPublisherConfig `yaml:"dapr"`
+}
+
+func (c PublisherConfig) Validate() error {
+	switch c.Type {
+	case "", PublisherNone, PublisherBus:
+		return nil
+	case PublisherFile:
+		if c.File.Path == "" {
+			return fmt.Errorf("publisher: file path could not be empty")
+		}
+		return nil
+	case PublisherDapr:
+		if c.Dapr.PubsubName == "" || c.Dapr.Topic == "" {
+			return fmt.Errorf("publisher: dapr pubsub name and topic could not be empty")
+		}
+		if _, err := url.Parse(c.Dapr.Address); err != nil {
+			return fmt.Errorf("publisher: invalid dapr address: %s", err.Error())
+		}
+		if c.Dapr.QueueSize <= 0 {
+			return fmt.Errorf("publisher: dapr queue size must be positive")
+		}
+		return nil
+	default:
+		return fmt.Errorf("publisher: unknown type %s", c.Type)
+	}
+}
+
+// NewPublisher : create the publisher selected by config
+func NewPublisher(c PublisherConfig) (Publisher, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Type {
+	case PublisherBus:
+		return NewBusPublisher(), nil
+	case PublisherFile:
+		return NewFilePublisher(c.File)
+	case PublisherDapr:
+		return NewDaprPublisher(c.Dapr), nil
+	default:
+		return noopPublisher{}, nil
+	}
+}
+
+// jsonPoint : json representation of a point
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+func newJsonPoint(p models.Point) (jsonPoint, error) {
+	fields, err := p.Fields()
+	if err != nil {
+		return jsonPoint{}, err
+	}
+	return jsonPoint{
+		Measurement: string(p.Name()),
+		Tags:        p.Tags().Map(),
+		Fields:      fields,
+		Time:        p.Time(),
+	}, nil
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(models.Point) error { return nil }
+
+func (noopPublisher) Close() error { return nil }
+
+// BusPublisher fans out points to in-process subscribers. Publishing never blocks,
+// a point is dropped for the subscribers whose channel is full.
+type BusPublisher struct {
+	mu          sync.RWMutex
+	subscribers map[int]chan models.Point
+	nextId      int
+	closed      bool
+}
+
+func NewBusPublisher() *BusPublisher {
+	return &BusPublisher{subscribers: make(map[int]chan models.Point)}
+}
+
+// Subscribe : register a subscriber with the given channel size. The returned function
+// removes the subscriber and closes its channel.
+func (b *BusPublisher) Subscribe(size int) (<-chan models.Point, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan models.Point, size)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := b.nextId
+	b.nextId++
+	b.subscribers[id] = ch
+
+	once := &sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.subscribers[id]; ok {
+				delete(b.subscribers, id)
+				close(ch)
+			}
+		})
+	}
+}
+
+func (b *BusPublisher) Publish(p models.Point) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	dropped := 0
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- p:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		return fmt.Errorf("bus: point dropped by %d slow subscribers", dropped)
+	}
+	return nil
+}
+
+func (b *BusPublisher) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, ch := range b.subscribers {
+		delete(b.subscribers, id)
+		close(ch)
+	}
+	b.closed = true
+	return nil
+}
+
+type FilePublisherConfig struct {
+	Path string `yaml:"path"`
+}
+
+// FilePublisher appends points to a local file, one json object per line
+type FilePublisher struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewFilePublisher(c FilePublisherConfig) (*FilePublisher, error) {
+	f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("publisher: open file failed: %s", err.Error())
+	}
+	return &FilePublisher{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+func (f *FilePublisher) Publish(p models.Point) error {
+	jp, err := newJsonPoint(p)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.encoder.Encode(jp)
+}
+
+func (f *FilePublisher) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+type DaprPublisherConfig struct {
+	Address    string        `yaml:"address"` // address of the dapr sidecar, like http://localhost:3500
+	PubsubName string        `yaml:"pubsub_name"`
+	Topic      string        `yaml:"topic"`
+	Timeout    time.Duration `yaml:"timeout"`
+	// max number of points waiting to be sent, points are dropped when the queue is full
+	QueueSize int `yaml:"queue_size"`
+}
+
+// DaprPublisher publishes points to a topic through the pub/sub api of the dapr sidecar.
+// Points are queued and sent in order by a background goroutine, so a slow sidecar
+// never blocks the caller. Publish fails when the queue is full.
+type DaprPublisher struct {
+	endpoint string
+	client   *http.Client
+
+	mu     sync.RWMutex
+	queue  chan []byte
+	closed bool
+	// closed when the queue is drained after close
+	doneH chan struct{}
+}
+
+func NewDaprPublisher(c DaprPublisherConfig) *DaprPublisher {
+	address := c.Address
+	if address == "" {
+		address = "http://localhost:3500"
+	}
+	d := &DaprPublisher{
+		endpoint: fmt.Sprintf("%s/v1.0/publish/%s/%s", address, url.PathEscape(c.PubsubName), url.PathEscape(c.Topic)),
+		client:   &http.Client{Timeout: c.Timeout},
+		queue:    make(chan []byte, c.QueueSize),
+		doneH:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *DaprPublisher) Publish(p models.Point) error {
+	jp, err := newJsonPoint(p)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(jp)
+	if err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return fmt.Errorf("dapr: publisher is closed")
+	}
+	select {
+	case d.queue <- body:
+		return nil
+	default:
+		return fmt.Errorf("dapr: publish queue is full, point dropped")
+	}
+}
+
+// run sends the queued points until the queue is closed. Once closed, the rest
+// of the queue is dropped after a failed send, so close never waits for a sidecar down.
+func (d *DaprPublisher) run() {
+	defer close(d.doneH)
+	dropped := 0
+	for body := range d.queue {
+		if dropped > 0 {
+			dropped++
+			continue
+		}
+		if err := d.send(body); err != nil {
+			logrus.Warnf("publish point to dapr failed: %s", err.Error())
+			if d.isClosed() {
+				dropped++
+			}
+		}
+	}
+	if dropped > 0 {
+		logrus.Errorf("dapr publisher closed, %d points not published", dropped)
+	}
+}
+
+func (d *DaprPublisher) send(body []byte) error {
+	resp, err := d.client.Post(d.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("dapr: publish failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("dapr: publish failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *DaprPublisher) isClosed() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.closed
+}
+
+// Close stops accepting points and waits for the queued points to be sent
+func (d *DaprPublisher) Close() error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	<-d.doneH
+	d.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"timeseries/pkg/models"
+)
+
+func testPoint(t *testing.T, value float64) models.Point {
+	p, err := models.NewPoint("cpu", models.NewTags(map[string]string{"host": "a"}), models.Fields{"value": value}, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestBusPublisher(t *testing.T) {
+	bus := NewBusPublisher()
+	fast, _ := bus.Subscribe(2)
+	slow, unsubscribe := bus.Subscribe(1)
+
+	if err := bus.Publish(testPoint(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// the slow subscriber misses the second point
+	if err := bus.Publish(testPoint(t, 2)); err == nil {
+		t.Error("point dropped by slow subscriber without error")
+	}
+	if len(fast) != 2 || len(slow) != 1 {
+		t.Errorf("points delivered = %d and %d, want 2 and 1", len(fast), len(slow))
+	}
+
+	unsubscribe()
+	unsubscribe()
+	<-slow
+	if _, ok := <-slow; ok {
+		t.Error("channel of unsubscribed subscriber not closed")
+	}
+
+	bus.Close()
+	<-fast
+	<-fast
+	if _, ok := <-fast; ok {
+		t.Error("channel not closed on close")
+	}
+	ch, _ := bus.Subscribe(1)
+	if _, ok := <-ch; ok {
+		t.Error("subscribed after close")
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.jsonl")
+	f, err := NewFilePublisher(FilePublisherConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []float64{1, 2} {
+		if err := f.Publish(testPoint(t, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var points []jsonPoint
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var jp jsonPoint
+		if err := json.Unmarshal(scanner.Bytes(), &jp); err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, jp)
+	}
+	if len(points) != 2 || points[1].Measurement != "cpu" || points[1].Tags["host"] != "a" || points[1].Fields["value"] != 2.0 {
+		t.Errorf("unexpected points %+v", points)
+	}
+}
+
+func TestDaprPublisher(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []jsonPoint
+	)
+	release := make(chan struct{})
+	sidecar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if r.URL.Path != "/v1.0/publish/pubsub/points" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var jp jsonPoint
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &jp)
+		mu.Lock()
+		bodies = append(bodies, jp)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer sidecar.Close()
+
+	conf := DefaultConfig().Publisher
+	conf.Type = PublisherDapr
+	conf.Dapr.Address = sidecar.URL
+	conf.Dapr.PubsubName = "pubsub"
+	conf.Dapr.Topic = "points"
+	conf.Dapr.QueueSize = 2
+	publisher, err := NewPublisher(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sidecar is stalled, points are queued without blocking until the queue is full
+	start := time.Now()
+	errs := 0
+	for i := 0; i < 4; i++ {
+		if err := publisher.Publish(testPoint(t, float64(i))); err != nil {
+			errs++
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("publish blocked by the sidecar for %s", time.Since(start))
+	}
+	// one point is taken by the sender, two are queued
+	if errs < 1 || errs > 2 {
+		t.Errorf("points dropped = %d, want the ones over the queue", errs)
+	}
+
+	close(release)
+	publisher.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 4-errs || bodies[0].Fields["value"] != 0.0 {
+		t.Errorf("unexpected points published %+v", bodies)
+	}
+	if err := publisher.Publish(testPoint(t, 5)); err == nil {
+		t.Error("published after close")
+	}
+}
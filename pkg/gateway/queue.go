@@ -0,0 +1,165 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"timeseries/pkg/models"
+)
+
+var (
+	// ErrQueueFull is returned when the point queue has no room for a batch
+	ErrQueueFull = errors.New("point queue is full")
+	// ErrBatchTooLarge is returned when a batch could never fit into the point queue
+	ErrBatchTooLarge = errors.New("batch is larger than the point queue")
+)
+
+// entry is the element of the point process queue
+type entry struct {
+	point  models.Point
+	bucket string
+	// project forced by the api key of the sender, empty when not forced
+	project string
+	// ack is not nil when the sender waits for the point to be stored
+	ack *ack
+	// wal segment holding the point, 0 when the wal is disabled
+	segment uint64
+}
+
+// ack tracks the points of a synchronous write. The workers collect the processed
+// points instead of storing them, so the sender writes them in one batch.
+type ack struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+	points map[string][]models.Point // by bucket
+	// buckets in the order their first points were processed
+	buckets []string
+	// number of points of each wal segment
+	segments map[uint64]int
+	// confirms the wal segments once the sender replied, stored or not
+	confirm  confirmFunc
+	released bool
+}
+
+// add collects a processed point
+func (a *ack) add(e entry) {
+	a.mu.Lock()
+	if a.released {
+		// the sender replied without the point, the client sends it again
+		a.mu.Unlock()
+		a.confirm(e.segment, 1)
+		a.wg.Done()
+		return
+	}
+	if a.points == nil {
+		a.points = make(map[string][]models.Point)
+		a.segments = make(map[uint64]int)
+	}
+	if _, ok := a.points[e.bucket]; !ok {
+		a.buckets = append(a.buckets, e.bucket)
+	}
+	a.points[e.bucket] = append(a.points[e.bucket], e.point)
+	if e.segment != 0 {
+		a.segments[e.segment]++
+	}
+	a.mu.Unlock()
+	a.wg.Done()
+}
+
+// done marks one point as processed without collecting it, the first error is kept
+func (a *ack) done(err error) {
+	if err != nil {
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = err
+		}
+		a.mu.Unlock()
+	}
+	a.wg.Done()
+}
+
+// release confirms the wal segments of the collected points after the sender replied,
+// the points processed later are confirmed when added
+func (a *ack) release() {
+	a.mu.Lock()
+	a.released = true
+	segments := a.segments
+	a.segments = nil
+	a.mu.Unlock()
+	for segment, n := range segments {
+		a.confirm(segment, n)
+	}
+}
+
+// wait blocks until all points are processed or ctx is done
+func (a *ack) wait(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue puts entries into the process queues. Room for the whole batch is reserved
+// before any entry is queued, so a batch is either queued completely or rejected.
+// When the queue is full, it waits at most admission timeout for room.
+// Entries are partitioned by series key, so points of a series are processed in order.
+// When the wal is enabled, entries are appended to it before queued.
+// Rejected entries are forgotten by the dedup stage.
+func (s *server) enqueue(ctx context.Context, entries []entry) (err error) {
+	defer func() {
+		if err != nil {
+			s.forget(entries)
+		}
+	}()
+	n := int64(len(entries))
+	if n == 0 {
+		return nil
+	}
+	if n > int64(s.conf.BufferSize) {
+		return ErrBatchTooLarge
+	}
+	if !s.admission.TryAcquire(n) {
+		if s.conf.AdmissionTimeout <= 0 {
+			return ErrQueueFull
+		}
+		timeoutCtx, cancel := context.WithTimeout(ctx, s.conf.AdmissionTimeout)
+		defer cancel()
+		if err := s.admission.Acquire(timeoutCtx, n); err != nil {
+			return ErrQueueFull
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.admission.Release(n)
+		return ErrServerStopping
+	}
+	// replayed entries are in the wal already
+	if s.wal != nil && entries[0].segment == 0 {
+		if err := s.appendWAL(entries); err != nil {
+			s.admission.Release(n)
+			return err
+		}
+	}
+	// never blocks, the reserved room is released after a point is processed
+	for i := range entries {
+		if entries[i].ack != nil {
+			entries[i].ack.wg.Add(1)
+		}
+		s.queues[entries[i].point.HashID()%uint64(len(s.queues))] <- entries[i]
+	}
+	s.stats.add(&s.stats.received, len(entries))
+	return nil
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"timeseries/pkg/models"
+	mysqlsvc "timeseries/pkg/service/mysql"
+)
+
+// modes of registry validation
+const (
+	RegistryOff        = "off"        // points are not validated
+	RegistryReject     = "reject"     // points of unknown sensors are rejected
+	RegistryTag        = "tag"        // points of unknown sensors are tagged unregistered=true
+	RegistryQuarantine = "quarantine" // points of unknown sensors are moved to the quarantine measurement
+)
+
+// tags identifying the sensor of a point
+const (
+	sensorMacTagKey = "sensor_mac"
+	receiveNoTagKey = "receive_no"
+)
+
+// max number of unknown sensors remembered, the least recently seen ones are forgotten
+const maxUnknownSensors = 1000
+
+// RegistryConfig : validation of points against the sensor registry in mysql
+type RegistryConfig struct {
+	Mode string `yaml:"mode"`
+	// registry is cached, changes take effect after refreshed
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// measurement of quarantined points, the original measurement is kept in tag original_measurement
+	QuarantineMeasurement string `yaml:"quarantine_measurement"`
+	// add project, type and location tags of the registered sensors to points
+	Enrich bool `yaml:"enrich"`
+}
+
+// Enabled : whether the registry is loaded
+func (c RegistryConfig) Enabled() bool {
+	return c.Mode != RegistryOff || c.Enrich
+}
+
+func (c RegistryConfig) Validate() error {
+	switch c.Mode {
+	case RegistryOff, RegistryReject, RegistryTag:
+	case RegistryQuarantine:
+		if c.QuarantineMeasurement == "" {
+			return fmt.Errorf("gateway: quarantine measurement could not be empty")
+		}
+	default:
+		return fmt.Errorf("gateway: unsupported registry mode %q", c.Mode)
+	}
+	if c.Enabled() && c.RefreshInterval <= 0 {
+		return fmt.Errorf("gateway: refresh interval of registry must be positive")
+	}
+	return nil
+}
+
+// locationKey : location of a project, ids of the lower levels are 0 for a higher level location
+type locationKey struct {
+	project int
+	ids     [4]int
+}
+
+// registryData : snapshot of the sensor registry
+type registryData struct {
+	sensors     map[string]models.SensorLocation        // by sensor mac
+	gatherTypes map[int]map[int]models.SensorGatherType // by sensor type and receive number
+	sensorTypes map[int]models.SensorType               // by id
+	locations   map[locationKey]models.SiteLocationName
+}
+
+// sensor returns the registered sensor of a mac. When project is not empty, as forced by
+// an api key, a sensor registered in another project is reported as not registered.
+func (d *registryData) sensor(mac, project string) (models.SensorLocation, bool) {
+	sensor, ok := d.sensors[mac]
+	if !ok || (project != "" && strconv.Itoa(sensor.ProjectId) != project) {
+		return models.SensorLocation{}, false
+	}
+	return sensor, true
+}
+
+// gatherType returns the gather type of a receive number of the sensor
+func (d *registryData) gatherType(sensor models.SensorLocation, receiveNo string) (models.SensorGatherType, bool) {
+	no, err := strconv.Atoi(receiveNo)
+	if err != nil {
+		return models.SensorGatherType{}, false
+	}
+	t, ok := d.gatherTypes[sensor.TypeId][no]
+	return t, ok
+}
+
+// registryLoader reads the whole registry
+type registryLoader func() (*registryData, error)
+
+// loadRegistry reads the registry from mysql
+func loadRegistry() (*registryData, error) {
+	var sensors []models.SensorLocation
+	if err := mysqlsvc.GetClient().Find(&sensors).Error; err != nil {
+		return nil, err
+	}
+	var gatherTypes []models.SensorGatherType
+	if err := mysqlsvc.GetClient().Find(&gatherTypes).Error; err != nil {
+		return nil, err
+	}
+	var sensorTypes []models.SensorType
+	if err := mysqlsvc.GetClient().Find(&sensorTypes).Error; err != nil {
+		return nil, err
+	}
+	var locations []models.SiteLocationName
+	if err := mysqlsvc.GetClient().Find(&locations).Error; err != nil {
+		return nil, err
+	}
+
+	d := &registryData{
+		sensors:     make(map[string]models.SensorLocation, len(sensors)),
+		gatherTypes: make(map[int]map[int]models.SensorGatherType),
+		sensorTypes: make(map[int]models.SensorType, len(sensorTypes)),
+		locations:   make(map[locationKey]models.SiteLocationName, len(locations)),
+	}
+	for _, s := range sensors {
+		d.sensors[s.SensorMac] = s
+	}
+	for _, t := range gatherTypes {
+		if d.gatherTypes[t.SensorTypeId] == nil {
+			d.gatherTypes[t.SensorTypeId] = make(map[int]models.SensorGatherType)
+		}
+		d.gatherTypes[t.SensorTypeId][t.ReceiveNumber] = t
+	}
+	for _, t := range sensorTypes {
+		d.sensorTypes[t.ID] = t
+	}
+	for _, l := range locations {
+		key := locationKey{project: l.ProjectId, ids: [4]int{l.Location1Id, l.Location2Id, l.Location3Id, l.Location4Id}}
+		d.locations[key] = l
+	}
+	return d, nil
+}
+
+// unknownSensor : a sensor mac and receive number seen in points but not registered
+type unknownSensor struct {
+	SensorMac string    `json:"sensor_mac"`
+	ReceiveNo string    `json:"receive_no,omitempty"`
+	Points    uint64    `json:"points"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// registry caches the sensor registry, refreshed periodically
+type registry struct {
+	load registryLoader
+
+	mu   sync.RWMutex
+	data *registryData
+
+	unknownMu sync.Mutex
+	unknown   *recentMap // of *unknownSensor by sensor mac and receive number
+
+	stopH chan struct{}
+}
+
+func newRegistry(load registryLoader, interval time.Duration) (*registry, error) {
+	r := &registry{
+		load:    load,
+		unknown: newRecentMap(maxUnknownSensors),
+		stopH:   make(chan struct{}),
+	}
+	if err := r.refresh(); err != nil {
+		return nil, fmt.Errorf("gateway: load sensor registry failed: %s", err.Error())
+	}
+	go refreshLoop(interval, r.stopH, "sensor registry", r.refresh)
+	return r, nil
+}
+
+func (r *registry) refresh() error {
+	data, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.data = data
+	r.mu.Unlock()
+	return nil
+}
+
+// snapshot returns the current registry, which must not be modified
+func (r *registry) snapshot() *registryData {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.data
+}
+
+// close stops refreshing
+func (r *registry) close() {
+	close(r.stopH)
+}
+
+// seen records a point of an unknown sensor
+func (r *registry) seen(mac, receiveNo string) {
+	now := time.Now().UTC()
+	key := mac + "/" + receiveNo
+
+	r.unknownMu.Lock()
+	defer r.unknownMu.Unlock()
+	if v, ok := r.unknown.get(key); ok {
+		u := v.(*unknownSensor)
+		u.Points++
+		u.LastSeen = now
+		return
+	}
+	r.unknown.add(key, &unknownSensor{SensorMac: mac, ReceiveNo: receiveNo, Points: 1, FirstSeen: now, LastSeen: now})
+}
+
+// unknownSensors returns the unknown sensors, the most recently seen first
+func (r *registry) unknownSensors() []unknownSensor {
+	r.unknownMu.Lock()
+	defer r.unknownMu.Unlock()
+	list := []unknownSensor{}
+	r.unknown.each(func(v interface{}) {
+		list = append(list, *v.(*unknownSensor))
+	})
+	return list
+}
+
+// registryStage validates the sensor of points against the registry.
+// Points without sensor mac tag are not sensor data and always pass.
+type registryStage struct {
+	registry *registry
+	conf     RegistryConfig
+}
+
+func (v *registryStage) apply(e *entry) error {
+	tags := e.point.Tags()
+	mac := tags.GetString(sensorMacTagKey)
+	if mac == "" {
+		return nil
+	}
+	receiveNo := tags.GetString(receiveNoTagKey)
+
+	data := v.registry.snapshot()
+	sensor, ok := data.sensor(mac, e.project)
+	if ok && receiveNo != "" {
+		_, ok = data.gatherType(sensor, receiveNo)
+	}
+	if ok {
+		return nil
+	}
+
+	v.registry.seen(mac, receiveNo)
+	switch v.conf.Mode {
+	case RegistryReject:
+		if receiveNo != "" {
+			return fmt.Errorf("sensor %s with receive number %s is not registered", mac, receiveNo)
+		}
+		return fmt.Errorf("sensor %s is not registered", mac)
+	case RegistryTag:
+		setTag(e.point, "unregistered", "true")
+	case RegistryQuarantine:
+		setTag(e.point, "original_measurement", string(e.point.Name()))
+		e.point.SetName(v.conf.QuarantineMeasurement)
+	}
+	return nil
+}
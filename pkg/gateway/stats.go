@@ -0,0 +1,43 @@
+package gateway
+
+import "sync/atomic"
+
+// stats : counters of the gateway, all fields must be accessed atomically
+type stats struct {
+	received    uint64 // points accepted by the receivers
+	rejected    uint64 // points rejected by the pipeline stages
+	dropped     uint64 // points dropped by the pipeline stages, e.g. duplicates
+	lost        uint64 // points still queued when the server stopped
+	stored      uint64 // points confirmed by influxdb
+	storeErrors uint64 // write requests to influxdb failed
+	published   uint64 // points delivered to the publisher
+	pubErrors   uint64 // points failed to publish
+	buffered    uint64 // failed batches saved into the disk buffer
+	forwarded   uint64 // buffered batches written into influxdb
+
+	mqttMessages uint64 // messages received from the mqtt broker
+	mqttInvalid  uint64 // mqtt messages could not be parsed completely
+	mqttDropped  uint64 // points of mqtt messages dropped because the queue is full
+}
+
+func (s *stats) add(counter *uint64, delta int) {
+	atomic.AddUint64(counter, uint64(delta))
+}
+
+func (s *stats) snapshot() map[string]uint64 {
+	return map[string]uint64{
+		"points_received":   atomic.LoadUint64(&s.received),
+		"points_rejected":   atomic.LoadUint64(&s.rejected),
+		"points_dropped":    atomic.LoadUint64(&s.dropped),
+		"points_lost":       atomic.LoadUint64(&s.lost),
+		"points_stored":     atomic.LoadUint64(&s.stored),
+		"store_errors":      atomic.LoadUint64(&s.storeErrors),
+		"points_published":  atomic.LoadUint64(&s.published),
+		"publish_errors":    atomic.LoadUint64(&s.pubErrors),
+		"batches_buffered":  atomic.LoadUint64(&s.buffered),
+		"batches_forwarded": atomic.LoadUint64(&s.forwarded),
+		"mqtt_messages":     atomic.LoadUint64(&s.mqttMessages),
+		"mqtt_invalid":      atomic.LoadUint64(&s.mqttInvalid),
+		"mqtt_dropped":      atomic.LoadUint64(&s.mqttDropped),
+	}
+}
@@ -0,0 +1,377 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"timeseries/pkg/gateway/buffer"
+	"timeseries/pkg/models"
+	influxsvc "timeseries/pkg/service/influxdb"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxapi "github.com/influxdata/influxdb-client-go/v2/api"
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/sirupsen/logrus"
+)
+
+// storage persists the points taken from the process queues
+type storage interface {
+	// write adds the point to the batch of its bucket, which is written in the background.
+	// segment is the wal segment of the point, 0 when none, confirmed after written.
+	write(bucket string, p models.Point, segment uint64)
+	// writeBatch writes the points immediately and returns after influxdb confirmed them
+	writeBatch(ctx context.Context, bucket string, points []models.Point) error
+	close()
+}
+
+// confirmFunc is called when n points of a wal segment no longer need the wal
+type confirmFunc func(segment uint64, n int)
+
+// number of full batches of a bucket waiting to be written, adding points blocks
+// when exceeded, so the process workers slow down while influxdb is slow
+const pendingBatches = 4
+
+// influxStorage writes points into influxdb in batches through the blocking write api,
+// instead of the non-blocking one which never confirms a write. Points are collected into a batch of each bucket, which is written when the batch
+// size is reached or the flush interval expires. Failed batches are retried every
+// retry interval up to max retries, points are only counted as stored after influxdb
+// confirmed them. When the disk buffer is enabled, batches failed with retryable errors
+// are spilled to it instead of retried, and forwarded once influxdb is reachable again.
+//
+// The wal segments of a batch are confirmed once the batch is written or spilled to
+// the disk buffer, and also when influxdb rejected it as invalid, since it would never
+// be written. Batches dropped after retries keep their segments for replay.
+type influxStorage struct {
+	client  influxdb2.Client
+	org     string
+	opts    influxsvc.WriteOptions
+	stats   *stats
+	confirm confirmFunc
+
+	mu      sync.Mutex
+	writers map[string]*bucketWriter
+	// closed when the storage is closing, failed batches are not retried then
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	buffer  *buffer.Buffer
+	backoff buffer.Backoff
+	// cancel stops forwarding buffered batches
+	cancel    context.CancelFunc
+	forwardWg sync.WaitGroup
+}
+
+// bucketWriter collects the points of a bucket into batches, which are written
+// in order by its goroutine
+type bucketWriter struct {
+	storage *influxStorage
+	bucket  string
+	api     influxapi.WriteAPIBlocking
+
+	mu      sync.Mutex
+	pending *batch
+	batches chan *batch
+}
+
+// batch : lines of points written in one request
+type batch struct {
+	lines strings.Builder
+	size  int
+	// number of points of each wal segment
+	segments map[uint64]int
+	// closed after the batch is written, nil when nobody waits for it
+	done chan struct{}
+}
+
+func newInfluxStorage(opts influxsvc.WriteOptions, httpClient *http.Client, st *stats, buf *buffer.Buffer, bufConf buffer.Config, confirm confirmFunc) *influxStorage {
+	s := &influxStorage{
+		client:  influxsvc.NewWriteClient(httpClient),
+		org:     influxsvc.GetAccount().Org,
+		opts:    opts,
+		stats:   st,
+		confirm: confirm,
+		writers: make(map[string]*bucketWriter),
+		closing: make(chan struct{}),
+		buffer:  buf,
+		backoff: buffer.Backoff{Initial: bufConf.InitialBackoff, Max: bufConf.MaxBackoff},
+		cancel:  func() {},
+	}
+	if buf != nil {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		s.forwardWg.Add(1)
+		go s.forward(ctx)
+	}
+	return s
+}
+
+// writer returns the writer of bucket, which is started on first use
+func (s *influxStorage) writer(bucket string) *bucketWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.writers[bucket]
+	if !ok {
+		w = &bucketWriter{
+			storage: s,
+			bucket:  bucket,
+			api:     s.client.WriteAPIBlocking(s.org, bucket),
+			batches: make(chan *batch, pendingBatches),
+		}
+		s.writers[bucket] = w
+		s.wg.Add(1)
+		go w.run()
+	}
+	return w
+}
+
+func (s *influxStorage) write(bucket string, p models.Point, segment uint64) {
+	s.writer(bucket).add(p, segment)
+}
+
+// writeBatch writes the points in requests of the batch size, a request of a synchronous
+// write usually fits into one
+func (s *influxStorage) writeBatch(ctx context.Context, bucket string, points []models.Point) error {
+	api := s.client.WriteAPIBlocking(s.org, bucket)
+	size := int(s.opts.BatchSize)
+	for start := 0; start < len(points); start += size {
+		end := start + size
+		if end > len(points) {
+			end = len(points)
+		}
+		lines := make([]string, 0, end-start)
+		for _, p := range points[start:end] {
+			lines = append(lines, p.String())
+		}
+		if err := api.WriteRecord(ctx, lines...); err != nil {
+			s.stats.add(&s.stats.storeErrors, 1)
+			return err
+		}
+		s.stats.add(&s.stats.stored, end-start)
+	}
+	return nil
+}
+
+func (s *influxStorage) bucketWriters() []*bucketWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writers := make([]*bucketWriter, 0, len(s.writers))
+	for _, w := range s.writers {
+		writers = append(writers, w)
+	}
+	return writers
+}
+
+// flush writes the pending batches of all buckets
+func (s *influxStorage) flush() {
+	for _, w := range s.bucketWriters() {
+		w.flush()
+	}
+}
+
+// close writes the pending batches without retrying failed ones, then stops
+// forwarding and releases the client. Must be called after the last write.
+func (s *influxStorage) close() {
+	close(s.closing)
+	for _, w := range s.bucketWriters() {
+		w.mu.Lock()
+		b := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		if b != nil {
+			w.batches <- b
+		}
+		close(w.batches)
+	}
+	s.wg.Wait()
+
+	s.cancel()
+	s.forwardWg.Wait()
+	s.client.Close()
+}
+
+// add appends the point to the pending batch, which is queued when full
+func (w *bucketWriter) add(p models.Point, segment uint64) {
+	w.mu.Lock()
+	if w.pending == nil {
+		w.pending = &batch{}
+	}
+	b := w.pending
+	if b.size > 0 {
+		b.lines.WriteByte('\n')
+	}
+	b.lines.WriteString(p.String())
+	b.size++
+	if segment != 0 {
+		if b.segments == nil {
+			b.segments = make(map[uint64]int)
+		}
+		b.segments[segment]++
+	}
+	if b.size < int(w.storage.opts.BatchSize) {
+		w.mu.Unlock()
+		return
+	}
+	w.pending = nil
+	w.mu.Unlock()
+	w.batches <- b
+}
+
+// flush queues the pending batch and waits until it and the batches before are written
+func (w *bucketWriter) flush() {
+	w.mu.Lock()
+	b := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	if b == nil {
+		b = &batch{}
+	}
+	b.done = make(chan struct{})
+	w.batches <- b
+	<-b.done
+}
+
+// run writes the queued batches, and the pending batch when the flush interval expires
+func (w *bucketWriter) run() {
+	defer w.storage.wg.Done()
+	ticker := time.NewTicker(w.storage.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case b, ok := <-w.batches:
+			if !ok {
+				return
+			}
+			w.send(b)
+		case <-ticker.C:
+			w.mu.Lock()
+			b := w.pending
+			w.pending = nil
+			w.mu.Unlock()
+			if b != nil {
+				w.send(b)
+			}
+		}
+	}
+}
+
+// send writes a batch, failed batches are retried or spilled to the disk buffer
+func (w *bucketWriter) send(b *batch) {
+	if b.done != nil {
+		defer close(b.done)
+	}
+	if b.size == 0 {
+		return
+	}
+	s := w.storage
+	lines := b.lines.String()
+	for retries := uint(0); ; retries++ {
+		err := w.api.WriteRecord(context.Background(), lines)
+		if err == nil {
+			s.stats.add(&s.stats.stored, b.size)
+			s.confirmBatch(b)
+			return
+		}
+		s.stats.add(&s.stats.storeErrors, 1)
+		if !retryable(err) {
+			logrus.Errorf("write %d points to influxdb bucket %s failed, batch dropped: %s", b.size, w.bucket, err.Error())
+			s.confirmBatch(b)
+			return
+		}
+		if s.buffer != nil {
+			if s.spill(w.bucket, lines) {
+				s.confirmBatch(b)
+			}
+			return
+		}
+		if retries >= s.opts.MaxRetries || s.isClosing() {
+			logrus.Errorf("write %d points to influxdb bucket %s failed after %d retries, batch dropped: %s", b.size, w.bucket, retries, err.Error())
+			return
+		}
+		logrus.Warnf("write %d points to influxdb bucket %s failed, retry in %s: %s", b.size, w.bucket, s.opts.RetryInterval, err.Error())
+		select {
+		case <-time.After(s.opts.RetryInterval):
+		case <-s.closing:
+		}
+	}
+}
+
+// confirmBatch confirms the wal segments of the batch
+func (s *influxStorage) confirmBatch(b *batch) {
+	if s.confirm == nil {
+		return
+	}
+	for segment, n := range b.segments {
+		s.confirm(segment, n)
+	}
+}
+
+func (s *influxStorage) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// spill saves a failed batch into the disk buffer, returns false if the batch is dropped
+func (s *influxStorage) spill(bucket, batch string) bool {
+	if err := s.buffer.Push(bucket, batch); err != nil {
+		logrus.Errorf("buffer batch of bucket %s failed, batch dropped: %s", bucket, err.Error())
+		return false
+	}
+	s.stats.add(&s.stats.buffered, 1)
+	logrus.Warnf("batch of bucket %s buffered on disk", bucket)
+	return true
+}
+
+// forward writes the buffered batches into influxdb oldest first, with exponential
+// backoff after failures
+func (s *influxStorage) forward(ctx context.Context) {
+	defer s.forwardWg.Done()
+	for {
+		batch := s.buffer.Peek()
+		if batch == nil {
+			select {
+			case <-s.buffer.Pushed():
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		err := s.client.WriteAPIBlocking(s.org, batch.Bucket).WriteRecord(ctx, batch.Lines)
+		if err == nil || !retryable(err) {
+			if err != nil {
+				logrus.Errorf("forward buffered batch to bucket %s failed, batch dropped: %s", batch.Bucket, err.Error())
+			} else {
+				s.stats.add(&s.stats.forwarded, 1)
+			}
+			if err := s.buffer.Remove(batch); err != nil {
+				logrus.Errorf("remove forwarded batch failed: %s", err.Error())
+			}
+			s.backoff.Reset()
+			continue
+		}
+
+		delay := s.backoff.Next()
+		logrus.Warnf("forward buffered batch failed, retry in %s: %s", delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryable reports whether a write error is temporary, the same as the client retries
+func retryable(err error) bool {
+	var herr *http2.Error
+	if !errors.As(err, &herr) {
+		return true
+	}
+	return herr.StatusCode == 0 || herr.StatusCode >= http.StatusTooManyRequests
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"timeseries/pkg/gateway/buffer"
+	"timeseries/pkg/models"
+	influxsvc "timeseries/pkg/service/influxdb"
+)
+
+var (
+	influxOnce    sync.Once
+	influxMu      sync.Mutex
+	influxHandler http.HandlerFunc
+)
+
+// startInflux serves the influxdb api of the running test by handler. The influxdb
+// client is initialized once in a process, so tests share one server.
+func startInflux(handler http.HandlerFunc) {
+	influxOnce.Do(func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			influxMu.Lock()
+			h := influxHandler
+			influxMu.Unlock()
+			h(w, r)
+		}))
+		influxsvc.InitInfluxClient(influxsvc.Account{Address: srv.URL, Org: "org", Token: "token", Bucket: "default"}, "default")
+	})
+	influxMu.Lock()
+	influxHandler = handler
+	influxMu.Unlock()
+}
+
+func TestStoreAndForward(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		available bool
+		written   []string
+	)
+	startInflux(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		written = append(written, r.URL.Query().Get("bucket")+":"+strings.TrimSpace(string(body)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	conf := DefaultConfig()
+	// failed batches are buffered without retries
+	conf.Storage.MaxRetries = 0
+	conf.Buffer = buffer.Config{Dir: t.TempDir(), MaxSize: 1 << 20, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	buf, err := buffer.Open(conf.Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &stats{}
+	storage := newInfluxStorage(conf.Storage, nil, st, buf, conf.Buffer, nil)
+	defer storage.close()
+
+	p, _ := models.NewPoint("cpu", nil, models.Fields{"value": 1.0}, time.Unix(1, 0))
+	storage.write("sensors", p, 0)
+	storage.flush()
+	if status := buf.Status(); status.Batches != 1 || status.Oldest == nil {
+		t.Fatalf("batch not buffered, status %+v", status)
+	}
+
+	mu.Lock()
+	available = true
+	mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for buf.Status().Batches > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 1 || written[0] != "sensors:cpu value=1 1000000000" {
+		t.Fatalf("unexpected writes %v", written)
+	}
+	if snapshot := st.snapshot(); snapshot["batches_buffered"] != 1 || snapshot["batches_forwarded"] != 1 {
+		t.Errorf("unexpected stats %v", snapshot)
+	}
+}
+
+func TestInfluxStorage(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failing  bool
+		requests []int // lines of each request
+	)
+	startInflux(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, strings.Count(strings.TrimSpace(string(body)), "\n")+1)
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	sent := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), requests...)
+	}
+
+	conf := DefaultConfig()
+	conf.Storage.FlushInterval = time.Hour
+	conf.Storage.MaxRetries = 1
+	conf.Storage.RetryInterval = time.Millisecond
+	st := &stats{}
+	storage := newInfluxStorage(conf.Storage, nil, st, nil, conf.Buffer, nil)
+	defer storage.close()
+
+	points := make([]models.Point, 5000)
+	for i := range points {
+		points[i], _ = models.NewPoint("cpu", nil, models.Fields{"value": float64(i)}, time.Unix(int64(i), 0))
+	}
+	if err := storage.writeBatch(context.Background(), "default", points); err != nil {
+		t.Fatal(err)
+	}
+	if requests := sent(); len(requests) != 1 || requests[0] != 5000 || st.snapshot()["points_stored"] != 5000 {
+		t.Fatalf("requests = %v, stored = %d", requests, st.snapshot()["points_stored"])
+	}
+
+	// points are stored once the batch is confirmed
+	for _, p := range points[:3] {
+		storage.write("default", p, 0)
+	}
+	if stored := st.snapshot()["points_stored"]; stored != 5000 {
+		t.Errorf("stored = %d before written", stored)
+	}
+	storage.flush()
+	if requests := sent(); len(requests) != 2 || requests[1] != 3 || st.snapshot()["points_stored"] != 5003 {
+		t.Fatalf("requests = %v, stored = %d", requests, st.snapshot()["points_stored"])
+	}
+
+	// failed batches are retried, then dropped
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	storage.write("default", points[0], 0)
+	storage.flush()
+	if err := storage.writeBatch(context.Background(), "default", points[:1]); err == nil {
+		t.Error("failed write confirmed")
+	}
+	snapshot := st.snapshot()
+	if requests := sent(); len(requests) != 5 || snapshot["points_stored"] != 5003 || snapshot["store_errors"] != 3 {
+		t.Errorf("requests = %v, stats = %v", requests, snapshot)
+	}
+}
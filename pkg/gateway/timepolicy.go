@@ -0,0 +1,140 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// actions on points out of the acceptance window
+const (
+	TimeReject     = "reject"     // points are rejected
+	TimeClamp      = "clamp"      // timestamp is replaced by the server time
+	TimeQuarantine = "quarantine" // points are written into the quarantine bucket
+)
+
+// max number of offending devices remembered, the least recently seen ones are forgotten
+const maxTimeOffenders = 1000
+
+// TimePolicyConfig : acceptance window of point timestamps relative to the server time
+type TimePolicyConfig struct {
+	MaxAge    time.Duration `yaml:"max_age"`    // points older are late, 0 means unlimited
+	MaxFuture time.Duration `yaml:"max_future"` // points later than now are future, 0 means unlimited
+	Action    string        `yaml:"action"`
+	// bucket of the points out of window when action is quarantine
+	QuarantineBucket string `yaml:"quarantine_bucket"`
+}
+
+// Enabled : whether any window is configured
+func (c TimePolicyConfig) Enabled() bool {
+	return c.MaxAge > 0 || c.MaxFuture > 0
+}
+
+func (c TimePolicyConfig) Validate() error {
+	if c.MaxAge < 0 || c.MaxFuture < 0 {
+		return fmt.Errorf("gateway: max age and max future of time policy could not be negative")
+	}
+	if !c.Enabled() {
+		return nil
+	}
+	switch c.Action {
+	case TimeReject, TimeClamp:
+	case TimeQuarantine:
+		if c.QuarantineBucket == "" {
+			return fmt.Errorf("gateway: quarantine bucket of time policy could not be empty")
+		}
+	default:
+		return fmt.Errorf("gateway: unsupported time policy action %q", c.Action)
+	}
+	return nil
+}
+
+// timeOffender : a device sending points out of the acceptance window
+type timeOffender struct {
+	Device   string    `json:"device"` // sensor mac, or measurement when absent
+	Late     uint64    `json:"late"`
+	Future   uint64    `json:"future"`
+	LastTime time.Time `json:"last_time"` // timestamp of the last offending point
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// timePolicyStage applies the action to points out of the acceptance window
+// and remembers the offending devices
+type timePolicyStage struct {
+	conf   TimePolicyConfig
+	bucket string // resolved quarantine bucket
+
+	mu        sync.Mutex
+	offenders *recentMap // of *timeOffender by device
+}
+
+func newTimePolicyStage(s *server, conf TimePolicyConfig) (*timePolicyStage, error) {
+	t := &timePolicyStage{conf: conf, offenders: newRecentMap(maxTimeOffenders)}
+	if conf.Action == TimeQuarantine {
+		bucket, ok := s.resolveBucket(conf.QuarantineBucket)
+		if !ok {
+			return nil, fmt.Errorf("gateway: quarantine bucket %q of time policy not found", conf.QuarantineBucket)
+		}
+		t.bucket = bucket
+	}
+	return t, nil
+}
+
+func (t *timePolicyStage) apply(e *entry) error {
+	now := time.Now().UTC()
+	ts := e.point.Time()
+	late := t.conf.MaxAge > 0 && ts.Before(now.Add(-t.conf.MaxAge))
+	future := t.conf.MaxFuture > 0 && ts.After(now.Add(t.conf.MaxFuture))
+	if !late && !future {
+		return nil
+	}
+
+	device := e.point.Tags().GetString(sensorMacTagKey)
+	if device == "" {
+		device = string(e.point.Name())
+	}
+	t.offend(device, ts, late, now)
+
+	switch t.conf.Action {
+	case TimeReject:
+		if late {
+			return fmt.Errorf("timestamp %s is older than %s", ts.Format(time.RFC3339Nano), t.conf.MaxAge)
+		}
+		return fmt.Errorf("timestamp %s is more than %s in the future", ts.Format(time.RFC3339Nano), t.conf.MaxFuture)
+	case TimeClamp:
+		e.point.SetTime(now)
+	case TimeQuarantine:
+		e.bucket = t.bucket
+	}
+	return nil
+}
+
+func (t *timePolicyStage) offend(device string, ts time.Time, late bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var o *timeOffender
+	if v, ok := t.offenders.get(device); ok {
+		o = v.(*timeOffender)
+	} else {
+		o = &timeOffender{Device: device}
+		t.offenders.add(device, o)
+	}
+	if late {
+		o.Late++
+	} else {
+		o.Future++
+	}
+	o.LastTime = ts
+	o.LastSeen = now
+}
+
+// violations returns the offending devices, the most recently seen first
+func (t *timePolicyStage) violations() []timeOffender {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := []timeOffender{}
+	t.offenders.each(func(v interface{}) {
+		list = append(list, *v.(*timeOffender))
+	})
+	return list
+}
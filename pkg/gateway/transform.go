@@ -0,0 +1,360 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"timeseries/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// TransformConfig : rules transforming points before validation, disabled when file is empty
+type TransformConfig struct {
+	// yaml file of the rules, reloaded when modified
+	File           string        `yaml:"file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+func (c TransformConfig) Validate() error {
+	if c.File != "" && c.ReloadInterval <= 0 {
+		return fmt.Errorf("gateway: reload interval of transform rules must be positive")
+	}
+	return nil
+}
+
+// TransformRules : content of the rules file
+type TransformRules struct {
+	Rules []TransformRule `yaml:"rules"`
+}
+
+// TransformRule : operations applied to the points matched, in the order of fields.
+// All rules matched are applied in order, a rule matches the point transformed by the rules before it.
+// The project_id tag forced by api keys could not be renamed or added by rules.
+type TransformRule struct {
+	Match             TransformMatch    `yaml:"match"`
+	RenameMeasurement string            `yaml:"rename_measurement"`
+	RenameTags        Renames           `yaml:"rename_tags"`
+	RenameFields      Renames           `yaml:"rename_fields"`
+	DropFields        []string          `yaml:"drop_fields"`
+	AddTags           map[string]string `yaml:"add_tags"` // replace the tags sent by devices, except project_id
+	Scale             []UnitScale       `yaml:"scale"`
+	// round timestamp to a multiple of the duration, 0 means not rounded
+	Round time.Duration `yaml:"round"`
+}
+
+// TransformMatch : points matched by a rule, an empty match matches all points
+type TransformMatch struct {
+	Measurement string            `yaml:"measurement"`
+	Tags        map[string]string `yaml:"tags"`
+}
+
+// Rename : rename a key to another
+type Rename struct {
+	From string
+	To   string
+}
+
+// Renames : renames written as a yaml map of old key to new key, applied in the order
+// written. Renames are chained, e.g. {a: b, b: c} renames both a and b to c.
+type Renames []Rename
+
+func (r *Renames) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items yaml.MapSlice
+	if err := unmarshal(&items); err != nil {
+		return err
+	}
+	renames := make(Renames, 0, len(items))
+	for _, item := range items {
+		from, ok := renameKey(item.Key)
+		if !ok {
+			return fmt.Errorf("invalid rename key %v", item.Key)
+		}
+		to, ok := renameKey(item.Value)
+		if !ok {
+			return fmt.Errorf("invalid rename key %v", item.Value)
+		}
+		renames = append(renames, Rename{From: from, To: to})
+	}
+	*r = renames
+	return nil
+}
+
+// renameKey returns the key of scalar yaml values, false for others
+func renameKey(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// UnitScale : convert numeric fields linearly as value * factor + offset when the unit of
+// the gather type registered for the sensor is the unit. Requires the sensor registry.
+// Integer fields stay integers, so the field type in influxdb never changes, the point
+// is rejected if an integer field is scaled by a fractional factor or offset.
+type UnitScale struct {
+	Unit   string   `yaml:"unit"`
+	Fields []string `yaml:"fields"` // all numeric fields when empty
+	Factor float64  `yaml:"factor"`
+	Offset float64  `yaml:"offset"`
+}
+
+func (r TransformRules) Validate() error {
+	for i, rule := range r.Rules {
+		for _, r := range rule.RenameTags {
+			if r.From == "" || r.To == "" {
+				return fmt.Errorf("rule %d: tag key of rename could not be empty", i+1)
+			}
+			if r.From == projectTagKey || r.To == projectTagKey {
+				return fmt.Errorf("rule %d: tag %s is forced by api keys and could not be renamed", i+1, projectTagKey)
+			}
+		}
+		for _, r := range rule.RenameFields {
+			if r.From == "" || r.To == "" {
+				return fmt.Errorf("rule %d: field key of rename could not be empty", i+1)
+			}
+		}
+		for k, v := range rule.AddTags {
+			if k == "" || v == "" {
+				return fmt.Errorf("rule %d: tag key and value could not be empty", i+1)
+			}
+			if k == projectTagKey {
+				return fmt.Errorf("rule %d: tag %s is forced by api keys and could not be added", i+1, projectTagKey)
+			}
+		}
+		for _, s := range rule.Scale {
+			if s.Unit == "" || s.Factor == 0 {
+				return fmt.Errorf("rule %d: unit and factor of scale could not be empty", i+1)
+			}
+		}
+		if rule.Round < 0 {
+			return fmt.Errorf("rule %d: round could not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+func (m TransformMatch) matches(p models.Point) bool {
+	if m.Measurement != "" && m.Measurement != string(p.Name()) {
+		return false
+	}
+	tags := p.Tags()
+	for k, v := range m.Tags {
+		if tags.GetString(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// loadTransformRules reads and validates the rules file
+func loadTransformRules(path string) (TransformRules, error) {
+	var rules TransformRules
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, fmt.Errorf("gateway: read transform rules failed: %s", err.Error())
+	}
+	if err := yaml.UnmarshalStrict(content, &rules); err != nil {
+		return rules, fmt.Errorf("gateway: parse transform rules failed: %s", err.Error())
+	}
+	if err := rules.Validate(); err != nil {
+		return rules, fmt.Errorf("gateway: invalid transform rules: %s", err.Error())
+	}
+	return rules, nil
+}
+
+// transformStage applies the rules of the file to points. The file is checked
+// periodically and reloaded when modified, invalid files are ignored.
+type transformStage struct {
+	conf     TransformConfig
+	registry *registry // nil when the registry is disabled, scale rules are rejected then
+
+	mu      sync.RWMutex
+	rules   []TransformRule
+	modTime time.Time
+
+	stopH chan struct{}
+}
+
+func newTransformStage(conf TransformConfig, reg *registry) (*transformStage, error) {
+	t := &transformStage{conf: conf, registry: reg, stopH: make(chan struct{})}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	go refreshLoop(conf.ReloadInterval, t.stopH, "transform rules", t.reload)
+	return t, nil
+}
+
+// reload loads the rules file if it is modified since last loaded
+func (t *transformStage) reload() error {
+	info, err := os.Stat(t.conf.File)
+	if err != nil {
+		return fmt.Errorf("gateway: read transform rules failed: %s", err.Error())
+	}
+	t.mu.RLock()
+	modified := !info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	rules, err := loadTransformRules(t.conf.File)
+	if err != nil {
+		return err
+	}
+	if t.registry == nil {
+		for i, rule := range rules.Rules {
+			if len(rule.Scale) > 0 {
+				return fmt.Errorf("gateway: invalid transform rules: rule %d: scale could not be used without the sensor registry", i+1)
+			}
+		}
+	}
+	t.mu.Lock()
+	t.rules = rules.Rules
+	t.modTime = info.ModTime()
+	t.mu.Unlock()
+	logrus.Infof("%d transform rules loaded from %s", len(rules.Rules), t.conf.File)
+	return nil
+}
+
+// close stops reloading
+func (t *transformStage) close() {
+	close(t.stopH)
+}
+
+func (t *transformStage) apply(e *entry) error {
+	t.mu.RLock()
+	rules := t.rules
+	t.mu.RUnlock()
+
+	for i := range rules {
+		if !rules[i].Match.matches(e.point) {
+			continue
+		}
+		p, err := t.transform(&rules[i], e.point)
+		if err != nil {
+			return err
+		}
+		e.point = p
+	}
+	return nil
+}
+
+// transform returns the point transformed by the rule
+func (t *transformStage) transform(rule *TransformRule, p models.Point) (models.Point, error) {
+	name := string(p.Name())
+	if rule.RenameMeasurement != "" {
+		name = rule.RenameMeasurement
+	}
+
+	tags := p.Tags().Clone()
+	for _, r := range rule.RenameTags {
+		if v := tags.GetString(r.From); v != "" {
+			tags.Delete([]byte(r.From))
+			tags.SetString(r.To, v)
+		}
+	}
+	for k, v := range rule.AddTags {
+		tags.SetString(k, v)
+	}
+
+	pointFields, err := p.Fields()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(models.Fields, len(pointFields))
+	for k, v := range pointFields {
+		fields[k] = v
+	}
+	for _, r := range rule.RenameFields {
+		if v, ok := fields[r.From]; ok {
+			delete(fields, r.From)
+			fields[r.To] = v
+		}
+	}
+	for _, k := range rule.DropFields {
+		delete(fields, k)
+	}
+	if len(rule.Scale) > 0 {
+		if err := t.scale(rule.Scale, tags, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	np, err := models.NewPoint(name, tags, fields, p.Time())
+	if err != nil {
+		return nil, fmt.Errorf("transform point failed: %s", err.Error())
+	}
+	if rule.Round > 0 {
+		np.Round(rule.Round)
+	}
+	return np, nil
+}
+
+// scale converts the fields by the unit registered for the sensor of the tags
+func (t *transformStage) scale(scales []UnitScale, tags models.Tags, fields models.Fields) error {
+	data := t.registry.snapshot()
+	sensor, ok := data.sensors[tags.GetString(sensorMacTagKey)]
+	if !ok {
+		return nil
+	}
+	gatherType, ok := data.gatherType(sensor, tags.GetString(receiveNoTagKey))
+	if !ok {
+		return nil
+	}
+
+	for _, s := range scales {
+		if s.Unit != gatherType.Unit {
+			continue
+		}
+		keys := s.Fields
+		if len(keys) == 0 {
+			for k := range fields {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			switch v := fields[k].(type) {
+			case float64:
+				fields[k] = v*s.Factor + s.Offset
+			case int64:
+				r, ok := s.scaleInt(float64(v))
+				if !ok {
+					return fmt.Errorf("transform point failed: integer field %s could not be scaled exactly", k)
+				}
+				fields[k] = int64(r)
+			case uint64:
+				r, ok := s.scaleInt(float64(v))
+				if !ok || r < 0 {
+					return fmt.Errorf("transform point failed: integer field %s could not be scaled exactly", k)
+				}
+				fields[k] = uint64(r)
+			}
+		}
+	}
+	return nil
+}
+
+// maxExactInt is the max integer float64 represents exactly
+const maxExactInt = 1 << 53
+
+// scaleInt scales an integer value, false if the result may be not an exact integer
+func (s UnitScale) scaleInt(v float64) (float64, bool) {
+	if s.Factor != math.Trunc(s.Factor) || s.Offset != math.Trunc(s.Offset) {
+		return 0, false
+	}
+	r := v*s.Factor + s.Offset
+	if math.Abs(v) > maxExactInt || math.Abs(r) > maxExactInt {
+		return 0, false
+	}
+	return r, true
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// precisions of influxdb 1.x, mapped to the precisions of models
+var v1Precisions = map[string]string{
+	"":   "ns",
+	"n":  "ns",
+	"ns": "ns",
+	"u":  "us",
+	"µ":  "us",
+	"us": "us",
+	"ms": "ms",
+	"s":  "s",
+	"m":  "m",
+	"h":  "h",
+}
+
+// DBRPMapping : map the database and retention policy of influxdb 1.x writes to a bucket
+type DBRPMapping struct {
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"` // empty matches all retention policies
+	Bucket          string `yaml:"bucket"`
+}
+
+// replyV1 replies errors of influxdb 1.x api
+func replyV1(ctx *gin.Context, status int, e writeError) {
+	msg := e.Message
+	if len(e.Errors) > 0 {
+		msg = fmt.Sprintf("%s: %s", msg, e.Errors[0].Message)
+	}
+	ctx.JSON(status, map[string]interface{}{"error": msg})
+}
+
+// mapDBRP returns the bucket of database and retention policy. Without a mapping,
+// the bucket is named "database/retention_policy" like influxdb 2.x does,
+// the retention policy is "autogen" by default.
+func (s *server) mapDBRP(db, rp string) string {
+	for _, m := range s.conf.DBRP {
+		if m.Database == db && (m.RetentionPolicy == "" || m.RetentionPolicy == rp) {
+			return m.Bucket
+		}
+	}
+	if rp == "" {
+		rp = "autogen"
+	}
+	return db + "/" + rp
+}
+
+// v1PointReceiver implements the write api of influxdb 1.x
+func (s *server) v1PointReceiver(ctx *gin.Context) {
+	db := ctx.Query("db")
+	if db == "" {
+		replyV1(ctx, http.StatusBadRequest, writeError{Code: errCodeInvalid, Message: "database is required"})
+		return
+	}
+	bucket, ok := s.resolveBucket(s.mapDBRP(db, ctx.Query("rp")))
+	if !ok {
+		replyV1(ctx, http.StatusNotFound, writeError{Code: errCodeNotFound, Message: fmt.Sprintf("database not found: \"%s\"", db)})
+		return
+	}
+	precision, ok := v1Precisions[ctx.Query("precision")]
+	if !ok {
+		replyV1(ctx, http.StatusBadRequest, writeError{Code: errCodeInvalid, Message: fmt.Sprintf("invalid precision %s", ctx.Query("precision"))})
+		return
+	}
+	partial := s.conf.PartialWrites
+	if v := ctx.Query("partial"); v != "" {
+		partial, _ = strconv.ParseBool(v)
+	}
+	sync, _ := strconv.ParseBool(ctx.Query("sync"))
+
+	body, err := s.requestBody(ctx)
+	if err != nil {
+		replyV1(ctx, http.StatusBadRequest, writeError{Code: errCodeInvalid, Message: err.Error()})
+		return
+	}
+
+	w := s.newWriteRequest(ctx, bucket, formatLine, partial, sync, replyV1)
+	if err := s.readLineProtocol(w, body, precision); err != nil {
+		w.abort()
+		s.replyReadError(ctx, err, replyV1)
+		return
+	}
+	w.finish(ctx)
+}
+
+// v1Result : result of a statement of influxdb 1.x query api
+type v1Result struct {
+	StatementId int        `json:"statement_id"`
+	Series      []v1Series `json:"series,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type v1Series struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Values  [][]interface{} `json:"values"`
+}
+
+// v1Query implements the statements of influxdb 1.x query api which are used by
+// write clients on start up. Databases could not be created through the gateway,
+// "CREATE DATABASE" succeeds for the known databases only.
+func (s *server) v1Query(ctx *gin.Context) {
+	q := ctx.Query("q")
+	if q == "" {
+		q = ctx.PostForm("q")
+	}
+	if strings.TrimSpace(q) == "" {
+		replyV1(ctx, http.StatusBadRequest, writeError{Code: errCodeInvalid, Message: "missing required parameter \"q\""})
+		return
+	}
+
+	var results []v1Result
+	for _, stmt := range strings.Split(q, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		result := v1Result{StatementId: len(results)}
+		words := strings.Fields(stmt)
+		switch {
+		case len(words) == 2 && strings.EqualFold(words[0], "SHOW") && strings.EqualFold(words[1], "DATABASES"):
+			series := v1Series{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{}}
+			for _, db := range s.v1Databases() {
+				series.Values = append(series.Values, []interface{}{db})
+			}
+			result.Series = []v1Series{series}
+		case len(words) >= 3 && strings.EqualFold(words[0], "CREATE") && strings.EqualFold(words[1], "DATABASE"):
+			db := strings.Trim(words[2], "\"")
+			if _, ok := s.resolveBucket(s.mapDBRP(db, "")); !ok {
+				result.Error = fmt.Sprintf("database not found: \"%s\"", db)
+			}
+		default:
+			result.Error = fmt.Sprintf("statement is not supported by gateway: %s", stmt)
+		}
+		results = append(results, result)
+	}
+	ctx.JSON(http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// v1Databases lists the databases could be written
+func (s *server) v1Databases() []string {
+	var dbs []string
+	seen := make(map[string]bool)
+	add := func(db string) {
+		if db != "" && !seen[db] {
+			seen[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+	for _, m := range s.conf.DBRP {
+		add(m.Database)
+	}
+	for _, b := range append([]string{s.bucket}, s.conf.Buckets...) {
+		add(strings.SplitN(b, "/", 2)[0])
+	}
+	return dbs
+}
+
+func (s *server) v1Ping(ctx *gin.Context) {
+	ctx.Header("X-Influxdb-Version", "1.8-compatible")
+	ctx.Status(http.StatusNoContent)
+}
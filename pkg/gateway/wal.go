@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	"timeseries/pkg/gateway/wal"
+
+	"github.com/sirupsen/logrus"
+)
+
+// how often the segments of stored points are removed
+const walTruncateInterval = time.Second
+
+// appendWAL writes entries into the wal and marks them with the segment
+func (s *server) appendWAL(entries []entry) error {
+	records := make([]wal.Record, len(entries))
+	for i, e := range entries {
+		records[i] = wal.Record{Bucket: e.bucket, Point: e.point}
+	}
+	id, err := s.wal.Append(records)
+	if err != nil {
+		logrus.Errorf("append points to wal failed: %s", err.Error())
+		return err
+	}
+	for i := range entries {
+		entries[i].segment = id
+	}
+	return nil
+}
+
+// replayWAL queues the points in the segments left by the last run,
+// waiting for room when the queue is full
+func (s *server) replayWAL() error {
+	replayed := 0
+	err := s.wal.Replay(func(id uint64, records []wal.Record) error {
+		size := s.chunkSize()
+		for start := 0; start < len(records); start += size {
+			end := start + size
+			if end > len(records) {
+				end = len(records)
+			}
+			entries := make([]entry, 0, end-start)
+			for _, r := range records[start:end] {
+				entries = append(entries, entry{point: r.Point, bucket: r.Bucket, segment: id})
+			}
+			for {
+				err := s.enqueue(context.Background(), entries)
+				if err == nil {
+					break
+				}
+				if err != ErrQueueFull {
+					return err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			replayed += len(entries)
+		}
+		return nil
+	})
+	if replayed > 0 {
+		logrus.Infof("replay %d points from wal", replayed)
+	}
+	return err
+}
+
+// walDone marks n points of the segment as done once storage confirmed them
+func (s *server) walDone(segment uint64, n int) {
+	if segment != 0 && s.wal != nil {
+		s.wal.Done(segment, n)
+	}
+}
+
+// truncateWAL removes the segments whose points are all confirmed by storage.
+// It stops when all workers exit.
+func (s *server) truncateWAL() {
+	defer s.walWg.Done()
+	ticker := time.NewTicker(walTruncateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ids := s.wal.Removable(); len(ids) > 0 {
+				if err := s.wal.Remove(ids); err != nil {
+					logrus.Errorf("truncate wal failed: %s", err.Error())
+				}
+			}
+		case <-s.doneH:
+			return
+		}
+	}
+}
+
+// closeWAL closes the wal after storage closed, segments of the confirmed points are removed
+func (s *server) closeWAL() {
+	if err := s.wal.Close(); err != nil {
+		logrus.Errorf("close wal failed: %s", err.Error())
+	}
+	if err := s.wal.Remove(s.wal.Removable()); err != nil {
+		logrus.Errorf("truncate wal failed: %s", err.Error())
+	}
+}
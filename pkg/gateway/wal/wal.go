@@ -0,0 +1,411 @@
+// Package wal implements the write-ahead log of the gateway. Points are appended
+// to segment files before they are acknowledged, a segment is removed after all
+// of its points are stored, so points left in segments are replayed on startup.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"timeseries/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fsync policies
+const (
+	FsyncAlways   = "always"   // sync after every append, before the points are acknowledged
+	FsyncInterval = "interval" // sync periodically, points of the last interval could be lost on power failure
+	FsyncNone     = "none"     // leave it to the operating system, points survive process crashes only
+)
+
+const segmentExt = ".wal"
+
+// size of the record header, payload length and crc32 of payload
+const headerSize = 8
+
+// max size of a record payload, larger lengths are treated as corruption
+const maxRecordSize = 64 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrClosed is returned when appending to a closed log
+var ErrClosed = errors.New("wal: log is closed")
+
+// Config : write-ahead log config, disabled when dir is empty
+type Config struct {
+	Dir           string        `yaml:"dir"`
+	SegmentSize   int64         `yaml:"segment_size"` // segment is rotated when its size reaches this
+	Fsync         string        `yaml:"fsync"`
+	FsyncInterval time.Duration `yaml:"fsync_interval"`
+}
+
+func (c Config) Validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+	if c.SegmentSize <= 0 {
+		return fmt.Errorf("wal: segment size must be positive")
+	}
+	switch c.Fsync {
+	case FsyncAlways, FsyncNone:
+	case FsyncInterval:
+		if c.FsyncInterval <= 0 {
+			return fmt.Errorf("wal: fsync interval must be positive")
+		}
+	default:
+		return fmt.Errorf("wal: unsupported fsync policy %q", c.Fsync)
+	}
+	return nil
+}
+
+// Record : a point and its bucket
+type Record struct {
+	Bucket string
+	Point  models.Point
+}
+
+// segment : a segment file and the number of its points not stored yet
+type segment struct {
+	id      uint64
+	pending int
+	sealed  bool // no more records are appended
+}
+
+// Log : segmented write-ahead log, safe for concurrent use
+type Log struct {
+	conf Config
+
+	mu       sync.Mutex
+	file     *os.File // file of the current segment
+	writer   *bufio.Writer
+	size     int64
+	dirty    bool // written but not synced
+	closed   bool
+	segments map[uint64]*segment
+	current  *segment
+
+	stopH chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Open opens the log in the directory, which is created if not exists.
+// Existing segments are kept for Replay, new records go to a new segment.
+func Open(conf Config) (*Log, error) {
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("wal: create dir failed: %s", err.Error())
+	}
+	ids, err := segmentIDs(conf.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		conf:     conf,
+		segments: make(map[uint64]*segment),
+		stopH:    make(chan struct{}),
+	}
+	var last uint64
+	for _, id := range ids {
+		l.segments[id] = &segment{id: id, sealed: true}
+		last = id
+	}
+	if err := l.openSegment(last + 1); err != nil {
+		return nil, err
+	}
+
+	if conf.Fsync == FsyncInterval {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// segmentIDs returns ids of the segment files in dir in ascending order
+func segmentIDs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: read dir failed: %s", err.Error())
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (l *Log) path(id uint64) string {
+	return filepath.Join(l.conf.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// openSegment creates the segment and makes it current, must be called with lock held
+func (l *Log) openSegment(id uint64) error {
+	f, err := os.OpenFile(l.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("wal: create segment failed: %s", err.Error())
+	}
+	l.file = f
+	l.writer = bufio.NewWriter(f)
+	l.size = 0
+	l.current = &segment{id: id}
+	l.segments[id] = l.current
+	return nil
+}
+
+// Append writes the records into the current segment and returns its id.
+// Records are durable according to the fsync policy when it returns.
+// Each record must be marked with Done after stored.
+func (l *Log) Append(records []Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	for _, r := range records {
+		if err := l.writeRecord(r); err != nil {
+			return 0, err
+		}
+	}
+	if err := l.writer.Flush(); err != nil {
+		return 0, fmt.Errorf("wal: write segment failed: %s", err.Error())
+	}
+	l.dirty = true
+	if l.conf.Fsync == FsyncAlways {
+		if err := l.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	seg := l.current
+	seg.pending += len(records)
+	if l.size >= l.conf.SegmentSize {
+		if err := l.rotate(); err != nil {
+			// records are written, the current segment is used until rotation succeeds
+			logrus.Errorf("rotate wal segment failed: %s", err.Error())
+		}
+	}
+	return seg.id, nil
+}
+
+// writeRecord encodes a record as the payload length, the crc32 of payload, and
+// the payload of bucket length, bucket and binary point
+func (l *Log) writeRecord(r Record) error {
+	pb, err := r.Point.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("wal: marshal point failed: %s", err.Error())
+	}
+	payload := make([]byte, 2+len(r.Bucket)+len(pb))
+	binary.BigEndian.PutUint16(payload, uint16(len(r.Bucket)))
+	copy(payload[2:], r.Bucket)
+	copy(payload[2+len(r.Bucket):], pb)
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload, castagnoli))
+	if _, err := l.writer.Write(header[:]); err != nil {
+		return fmt.Errorf("wal: write segment failed: %s", err.Error())
+	}
+	if _, err := l.writer.Write(payload); err != nil {
+		return fmt.Errorf("wal: write segment failed: %s", err.Error())
+	}
+	l.size += int64(headerSize + len(payload))
+	return nil
+}
+
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("wal: sync segment failed: %s", err.Error())
+	}
+	l.dirty = false
+	return nil
+}
+
+// rotate seals the current segment and opens the next one
+func (l *Log) rotate() error {
+	if err := l.sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("wal: close segment failed: %s", err.Error())
+	}
+	l.current.sealed = true
+	return l.openSegment(l.current.id + 1)
+}
+
+func (l *Log) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.conf.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if err := l.sync(); err != nil {
+				logrus.Errorf("sync wal failed: %s", err.Error())
+			}
+			l.mu.Unlock()
+		case <-l.stopH:
+			return
+		}
+	}
+}
+
+// Done marks n records of the segment as stored
+func (l *Log) Done(id uint64, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seg, ok := l.segments[id]; ok {
+		seg.pending -= n
+	}
+}
+
+// Removable returns ids of the sealed segments whose records are all done
+func (l *Log) Removable() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ids []uint64
+	for id, seg := range l.segments {
+		if seg.sealed && seg.pending <= 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Remove deletes the segment files
+func (l *Log) Remove(ids []uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		if seg, ok := l.segments[id]; !ok || !seg.sealed {
+			continue
+		}
+		if err := os.Remove(l.path(id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("wal: remove segment failed: %s", err.Error())
+		}
+		delete(l.segments, id)
+	}
+	return nil
+}
+
+// Replay reads the records of the segments existing when the log opened, oldest first.
+// fn is called with the segment id and its records, records of a segment are all read
+// before fn is called. A torn or corrupted tail of a segment is skipped.
+func (l *Log) Replay(fn func(id uint64, records []Record) error) error {
+	l.mu.Lock()
+	var ids []uint64
+	for id, seg := range l.segments {
+		if seg != l.current && seg.sealed {
+			ids = append(ids, id)
+		}
+	}
+	l.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		records, err := l.readSegment(id)
+		if err != nil {
+			logrus.Warnf("wal segment %d is truncated: %s", id, err.Error())
+		}
+		l.mu.Lock()
+		l.segments[id].pending += len(records)
+		l.mu.Unlock()
+		if len(records) == 0 {
+			continue
+		}
+		if err := fn(id, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment returns the valid records of a segment, with the error where reading stopped
+func (l *Log) readSegment(id uint64) ([]Record, error) {
+	f, err := os.Open(l.path(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var records []Record
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return records, err
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if size < 2 || size > maxRecordSize {
+			return records, fmt.Errorf("invalid record size %d", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return records, err
+		}
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:]) {
+			return records, fmt.Errorf("checksum mismatch")
+		}
+
+		n := int(binary.BigEndian.Uint16(payload))
+		if 2+n > len(payload) {
+			return records, fmt.Errorf("invalid bucket size %d", n)
+		}
+		p, err := models.NewPointFromBytes(payload[2+n:])
+		if err != nil {
+			return records, err
+		}
+		records = append(records, Record{Bucket: string(payload[2 : 2+n]), Point: p})
+	}
+}
+
+// Close syncs and seals the current segment. Segments with pending records are kept
+// and replayed after the log opened again.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.stopH)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.sync(); err != nil {
+		return err
+	}
+	l.current.sealed = true
+	return l.file.Close()
+}
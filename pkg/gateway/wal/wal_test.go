@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"timeseries/pkg/models"
+)
+
+func testRecords(t *testing.T, n int) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		p, err := models.NewPoint("cpu", models.NewTags(map[string]string{"host": "a"}), models.Fields{"value": float64(i)}, time.Unix(int64(i), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[i] = Record{Bucket: "sensors", Point: p}
+	}
+	return records
+}
+
+func TestReplay(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), SegmentSize: 100, Fsync: FsyncAlways}
+	l, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := l.Append(testRecords(t, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.Append(testRecords(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("segment not rotated")
+	}
+	// the first segment is stored, the second one is not
+	l.Done(first, 3)
+	if ids := l.Removable(); len(ids) != 1 || ids[0] != first {
+		t.Fatalf("removable = %v, want [%d]", ids, first)
+	}
+	if err := l.Remove([]uint64{first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// torn record at the tail of the second segment
+	f, err := os.OpenFile(l.path(second), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 10, 1, 2})
+	f.Close()
+
+	l, err = Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var replayed []Record
+	err = l.Replay(func(id uint64, records []Record) error {
+		if id != second {
+			t.Errorf("replay segment %d, want %d", id, second)
+		}
+		replayed = append(replayed, records...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[1].Bucket != "sensors" || replayed[1].Point.Time().Unix() != 1 {
+		t.Fatalf("unexpected replayed records %v", replayed)
+	}
+	// the second segment is pending until replayed points are done,
+	// the empty segment opened after it is removable
+	if ids := l.Removable(); len(ids) != 1 || ids[0] != second+1 {
+		t.Errorf("removable = %v, want [%d]", ids, second+1)
+	}
+}
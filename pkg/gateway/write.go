@@ -0,0 +1,425 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"timeseries/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// error codes replied by the write api, the same as influxdb v2
+const (
+	errCodeInvalid         = "invalid"
+	errCodeUnauthorized    = "unauthorized"
+	errCodeNotFound        = "not found"
+	errCodeTooLarge        = "request too large"
+	errCodeTooManyRequests = "too many requests"
+	errCodeUnavailable     = "unavailable"
+)
+
+// points of a request are queued in chunks of this size while the body is parsed
+const writeChunkSize = 5000
+
+// max number of line errors listed in a reply
+const maxLineErrors = 100
+
+// ErrBodyTooLarge is returned when a request body exceeds the max body size
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// lineError : error of a line in the request body
+type lineError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// writeError : error reply of the write api, compatible with influxdb v2.
+// Line is the first failed line, Errors lists the failed lines.
+type writeError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Line    int         `json:"line,omitempty"`
+	Errors  []lineError `json:"errors,omitempty"`
+}
+
+// replyFunc writes the error reply in the format of an api version
+type replyFunc func(ctx *gin.Context, status int, e writeError)
+
+// replyV2 replies errors of influxdb v2 api
+func replyV2(ctx *gin.Context, status int, e writeError) {
+	ctx.JSON(status, e)
+}
+
+func replyWriteError(ctx *gin.Context, status int, code, msg string) {
+	replyV2(ctx, status, writeError{Code: code, Message: msg})
+}
+
+// limitedReader fails with ErrBodyTooLarge once more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// requestBody returns the decompressed request body, limited to max body size
+func (s *server) requestBody(ctx *gin.Context) (io.Reader, error) {
+	var body io.Reader = ctx.Request.Body
+	switch ctx.GetHeader("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %s", err.Error())
+		}
+		body = gz
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", ctx.GetHeader("Content-Encoding"))
+	}
+	if s.conf.MaxBodySize > 0 {
+		body = &limitedReader{r: body, n: s.conf.MaxBodySize}
+	}
+	return body, nil
+}
+
+// resolveBucket checks whether points could be written into the bucket,
+// an empty name means the default bucket
+func (s *server) resolveBucket(name string) (string, bool) {
+	if name == "" || name == s.bucket {
+		return s.bucket, true
+	}
+	for _, b := range s.conf.Buckets {
+		if b == name {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// writeRequest collects the points of a write request and queues them in chunks,
+// so the body is never buffered completely.
+//
+// In strict mode the request is rejected if any line is invalid, and points after
+// the first invalid line are discarded. Chunks queued before are kept, which only
+// happens to bodies larger than a chunk. In partial mode valid points are always queued.
+type writeRequest struct {
+	ctx     context.Context
+	server  *server
+	bucket  string
+	partial bool
+	ack     *ack
+	reply   replyFunc
+	// format of the body, label of the point metrics
+	format string
+	// project of the api key, forced as tag of all points
+	project string
+
+	chunk []entry
+	// entries queued by a synchronous request, forgotten by dedup if not stored
+	queued   []entry
+	accepted int
+	rejected int
+	errors   []lineError
+	// error of queueing, the request could not continue
+	err error
+}
+
+func (s *server) newWriteRequest(ctx *gin.Context, bucket, format string, partial, sync bool, reply replyFunc) *writeRequest {
+	w := &writeRequest{
+		ctx:     ctx.Request.Context(),
+		server:  s,
+		bucket:  bucket,
+		partial: partial,
+		reply:   reply,
+		format:  format,
+		project: ctx.GetString(projectContextKey),
+		chunk:   make([]entry, 0, s.chunkSize()),
+	}
+	// reply after points are stored when the client asks for a synchronous write
+	if sync {
+		w.ack = &ack{confirm: s.walDone}
+	}
+	return w
+}
+
+// add queues the point of the line, returns false if the request could not continue.
+// A point rejected by the pipeline is recorded as an invalid line, dropped points are not.
+func (w *writeRequest) add(line int, p models.Point) bool {
+	if w.err != nil {
+		return false
+	}
+	w.server.metrics.pointsParsed(sourceHTTP, w.format, w.project, 1)
+	if w.rejected > 0 && !w.partial {
+		return true
+	}
+	if w.project != "" {
+		// devices of a project could not write into series of another project
+		setTag(p, projectTagKey, w.project)
+	}
+	e := entry{point: p, bucket: w.bucket, project: w.project, ack: w.ack}
+	if err := w.server.prepare(&e); err != nil {
+		if err != errDropped {
+			w.server.metrics.pointsRejected(sourceHTTP, w.format, w.project, 1)
+			w.record(line, err)
+		}
+		return true
+	}
+	w.chunk = append(w.chunk, e)
+	if len(w.chunk) == cap(w.chunk) {
+		return w.flush()
+	}
+	return true
+}
+
+// fail records a line could not be parsed
+func (w *writeRequest) fail(line int, err error) {
+	w.server.metrics.pointsMalformed(sourceHTTP, w.format, w.project, 1)
+	w.record(line, err)
+}
+
+// record records an invalid line
+func (w *writeRequest) record(line int, err error) {
+	w.rejected++
+	if len(w.errors) < maxLineErrors {
+		w.errors = append(w.errors, lineError{Line: line, Message: err.Error()})
+	}
+}
+
+func (w *writeRequest) flush() bool {
+	if err := w.server.enqueue(w.ctx, w.chunk); err != nil {
+		w.err = err
+		return false
+	}
+	if w.ack != nil {
+		w.queued = append(w.queued, w.chunk...)
+	}
+	w.accepted += len(w.chunk)
+	w.chunk = w.chunk[:0]
+	return true
+}
+
+// finish queues the rest points and replies the result of the request
+func (w *writeRequest) finish(ctx *gin.Context) {
+	if w.err == nil && (w.rejected == 0 || w.partial) {
+		w.flush()
+	} else {
+		// discarded, the points could be sent again
+		w.server.forget(w.chunk)
+	}
+	// the chunks queued before a failed one are stored as well
+	if w.ack != nil {
+		if err := w.store(); err != nil && w.err == nil {
+			w.server.setRetryAfter(ctx)
+			w.reply(ctx, http.StatusServiceUnavailable, writeError{Code: errCodeUnavailable, Message: fmt.Sprintf("points not confirmed by storage: %s", err.Error())})
+			return
+		}
+	}
+	if w.err != nil {
+		w.server.replyEnqueueError(ctx, w.err, w.reply)
+		return
+	}
+
+	if w.rejected > 0 {
+		msg := fmt.Sprintf("%d lines rejected, batch discarded", w.rejected)
+		if w.partial || w.accepted > 0 {
+			msg = fmt.Sprintf("partial write: %d lines rejected, %d points accepted", w.rejected, w.accepted)
+		}
+		w.reply(ctx, http.StatusBadRequest, writeError{
+			Code:    errCodeInvalid,
+			Message: msg,
+			Line:    w.errors[0].Line,
+			Errors:  w.errors,
+		})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// store waits for the points queued by a synchronous request and stores them. The
+// points are forgotten by dedup if not stored, and the wal never keeps them either way,
+// since the client is told whether to send them again.
+func (w *writeRequest) store() error {
+	defer w.ack.release()
+	waitCtx, cancel := context.WithTimeout(w.ctx, w.server.conf.SyncTimeout)
+	defer cancel()
+	err := w.ack.wait(waitCtx)
+	if err == nil {
+		err = w.server.storeToInfluxdbSync(waitCtx, w.ack)
+	}
+	if err != nil {
+		w.server.forget(w.queued)
+	}
+	return err
+}
+
+// abort discards the request when its body could not be read. The client sends the
+// whole body again, so the points not queued yet are forgotten by dedup, as well as
+// the ones queued by a synchronous request, which are never stored.
+func (w *writeRequest) abort() {
+	w.server.forget(w.chunk)
+	if w.ack != nil {
+		w.server.forget(w.queued)
+		w.ack.release()
+	}
+}
+
+// pointReceiver implements the write api of influxdb v2. Besides line protocol,
+// bodies of json (application/json) and csv (text/csv) are accepted.
+func (s *server) pointReceiver(ctx *gin.Context) {
+	if org := ctx.Query("org"); org != "" && s.org != "" && org != s.org {
+		replyWriteError(ctx, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("organization name \"%s\" not found", org))
+		return
+	}
+	bucket, ok := s.resolveBucket(ctx.Query("bucket"))
+	if !ok {
+		replyWriteError(ctx, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("bucket \"%s\" not found", ctx.Query("bucket")))
+		return
+	}
+	precision := ctx.Query("precision")
+	if precision == "" {
+		precision = "ns"
+	}
+	if !models.ValidPrecision(precision) {
+		replyWriteError(ctx, http.StatusBadRequest, errCodeInvalid, fmt.Sprintf("invalid precision %s", precision))
+		return
+	}
+	partial := s.conf.PartialWrites
+	if v := ctx.Query("partial"); v != "" {
+		partial, _ = strconv.ParseBool(v)
+	}
+	sync, _ := strconv.ParseBool(ctx.Query("sync"))
+
+	body, err := s.requestBody(ctx)
+	if err != nil {
+		replyWriteError(ctx, http.StatusBadRequest, errCodeInvalid, err.Error())
+		return
+	}
+
+	var w *writeRequest
+	switch ctx.ContentType() {
+	case "application/json":
+		w = s.newWriteRequest(ctx, bucket, formatJSON, partial, sync, replyV2)
+		err = s.readJSON(w, body, precision)
+	case "text/csv":
+		w = s.newWriteRequest(ctx, bucket, formatCSV, partial, sync, replyV2)
+		err = s.readCSV(w, body, precision, newCsvOptions(ctx))
+	default:
+		w = s.newWriteRequest(ctx, bucket, formatLine, partial, sync, replyV2)
+		err = s.readLineProtocol(w, body, precision)
+	}
+	if err != nil {
+		w.abort()
+		s.replyReadError(ctx, err, replyV2)
+		return
+	}
+	w.finish(ctx)
+}
+
+// newCsvOptions reads the column mapping of csv body from query params
+func newCsvOptions(ctx *gin.Context) csvOptions {
+	opts := csvOptions{
+		measurement:       ctx.Query("measurement"),
+		measurementColumn: ctx.DefaultQuery("measurement_column", "measurement"),
+		timeColumn:        ctx.DefaultQuery("time_column", "time"),
+		tagColumns:        make(map[string]bool),
+	}
+	for _, column := range strings.Split(ctx.Query("tag_columns"), ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			opts.tagColumns[column] = true
+		}
+	}
+	return opts
+}
+
+// readLineProtocol parses the body line by line into the write request
+func (s *server) readLineProtocol(w *writeRequest, body io.Reader, precision string) error {
+	now := time.Now().UTC()
+	scanner := models.NewLineScanner(body)
+	for scanner.Scan() {
+		p, err := models.ParseLineWithPrecision(scanner.Bytes(), now, precision)
+		if err != nil {
+			w.fail(scanner.Line(), fmt.Errorf("unable to parse '%s': %v", string(scanner.Bytes()), err))
+			continue
+		}
+		if !w.add(scanner.Line(), p) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// parseLines parses a buffer of line protocol line by line, so the lines failed to
+// parse are counted. The error of the first failed line is returned.
+func parseLines(buf []byte, precision string) ([]models.Point, int, error) {
+	now := time.Now().UTC()
+	var (
+		points   []models.Point
+		failed   int
+		firstErr error
+	)
+	scanner := models.NewLineScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		p, err := models.ParseLineWithPrecision(scanner.Bytes(), now, precision)
+		if err != nil {
+			if failed == 0 {
+				firstErr = fmt.Errorf("unable to parse '%s': %v", string(scanner.Bytes()), err)
+			}
+			failed++
+			continue
+		}
+		points = append(points, p)
+	}
+	return points, failed, firstErr
+}
+
+func (s *server) replyReadError(ctx *gin.Context, err error, reply replyFunc) {
+	if errors.Is(err, ErrBodyTooLarge) {
+		reply(ctx, http.StatusRequestEntityTooLarge, writeError{Code: errCodeTooLarge, Message: err.Error()})
+		return
+	}
+	reply(ctx, http.StatusBadRequest, writeError{Code: errCodeInvalid, Message: fmt.Sprintf("read body failed: %s", err.Error())})
+}
+
+func (s *server) chunkSize() int {
+	if s.conf.BufferSize < writeChunkSize {
+		return s.conf.BufferSize
+	}
+	return writeChunkSize
+}
+
+func (s *server) replyEnqueueError(ctx *gin.Context, err error, reply replyFunc) {
+	switch err {
+	case ErrBatchTooLarge:
+		reply(ctx, http.StatusRequestEntityTooLarge, writeError{Code: errCodeTooLarge, Message: err.Error()})
+	case ErrQueueFull:
+		s.setRetryAfter(ctx)
+		reply(ctx, http.StatusTooManyRequests, writeError{Code: errCodeTooManyRequests, Message: err.Error()})
+	default:
+		s.setRetryAfter(ctx)
+		reply(ctx, http.StatusServiceUnavailable, writeError{Code: errCodeUnavailable, Message: err.Error()})
+	}
+}
+
+func (s *server) setRetryAfter(ctx *gin.Context) {
+	seconds := int(s.conf.RetryAfter / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,44 @@
+package lambda
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+)
+
+// kinds of expression errors, matched by errors.Is
+var (
+	ErrSyntax      = errors.New("syntax error")
+	ErrUndefined   = errors.New("undefined")
+	ErrType        = errors.New("type mismatch")
+	ErrDivByZero   = errors.New("division by zero")
+	ErrUnsupported = errors.New("unsupported")
+	ErrCall        = errors.New("function failed")
+	ErrNull        = errors.New("null result")
+)
+
+// errNull is returned when a bool or number is expected but the result is null
+var errNull = &Error{Kind: ErrNull, Msg: "result is null because of missing data"}
+
+// Error : error of an expression. Pos is the 1-based offset in the source of an
+// expression parsed by Parse, 0 when unknown.
+type Error struct {
+	Pos  int
+	Kind error // one of the kinds above
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Pos > 0 {
+		return fmt.Sprintf("lambda: %s at %d: %s", e.Kind.Error(), e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("lambda: %s: %s", e.Kind.Error(), e.Msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func newError(pos token.Pos, kind error, format string, args ...interface{}) *Error {
+	return &Error{Pos: int(pos), Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,207 @@
+package lambda
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"math"
+	"sync"
+	"time"
+)
+
+// Func : a function could be called by expressions. Arguments are checked against
+// Args on compile, ints are accepted by float arguments.
+type Func struct {
+	Args []Type
+	// the last argument repeats, it is given at least once
+	Variadic bool
+	Result   Type
+	// Call must not keep args, which are reused by the next call
+	Call func(args []Value) (Value, error)
+}
+
+var (
+	funcsMu sync.RWMutex
+	funcs   = make(map[string]Func)
+)
+
+// Register adds a function by name, builtin functions could be replaced.
+// Programs compiled before are not affected.
+func Register(name string, f Func) error {
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("lambda: invalid function name %q", name)
+	}
+	if _, ok := aggregates[name]; ok {
+		return fmt.Errorf("lambda: function %s is an aggregate", name)
+	}
+	if _, ok := nullFuncs[name]; ok {
+		return fmt.Errorf("lambda: function %s is reserved", name)
+	}
+	if f.Call == nil {
+		return fmt.Errorf("lambda: function %s without implementation", name)
+	}
+	if f.Variadic && len(f.Args) == 0 {
+		return fmt.Errorf("lambda: variadic function %s without arguments", name)
+	}
+	if !validType(f.Result) {
+		return fmt.Errorf("lambda: invalid result type of function %s", name)
+	}
+	for _, t := range f.Args {
+		if !validType(t) {
+			return fmt.Errorf("lambda: invalid argument type of function %s", name)
+		}
+	}
+	f.Args = append([]Type(nil), f.Args...)
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	funcs[name] = f
+	return nil
+}
+
+func validType(t Type) bool {
+	return t > Invalid && t <= Time
+}
+
+// lookupFunc returns the registered function called by expr
+func lookupFunc(expr *ast.CallExpr) (string, Func, error) {
+	fun, ok := expr.Fun.(*ast.Ident)
+	if !ok {
+		return "", Func{}, newError(expr.Pos(), ErrUnsupported, "call of %T", expr.Fun)
+	}
+	funcsMu.RLock()
+	f, ok := funcs[fun.Name]
+	funcsMu.RUnlock()
+	if !ok {
+		return "", Func{}, newError(fun.Pos(), ErrUndefined, "function %s", fun.Name)
+	}
+	return fun.Name, f, nil
+}
+
+// check checks the number and types of arguments, types of null arguments are
+// Invalid, which are not checked
+func (f Func) check(expr *ast.CallExpr, types []Type) error {
+	name := expr.Fun.(*ast.Ident).Name
+	if len(types) < len(f.Args) || (!f.Variadic && len(types) > len(f.Args)) {
+		want := fmt.Sprint(len(f.Args))
+		if f.Variadic {
+			want = "at least " + want
+		}
+		return newError(expr.Lparen, ErrType, "%s takes %s arguments, %d given", name, want, len(types))
+	}
+	for i, t := range types {
+		want := f.Args[len(f.Args)-1]
+		if i < len(f.Args) {
+			want = f.Args[i]
+		}
+		if t != want && !(t == Int && want == Float) && t != Invalid {
+			return newError(expr.Args[i].Pos(), ErrType, "argument %d of %s is %s, not %s", i+1, name, t, want)
+		}
+	}
+	return nil
+}
+
+// callError positions the error returned by a function
+func callError(expr *ast.CallExpr, name string, err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return newError(expr.Pos(), ErrCall, "%s: %s", name, err.Error())
+}
+
+// evalCall calls a function with the evaluated arguments, the result is null
+// if any argument is null
+func evalCall(expr *ast.CallExpr, data map[string]interface{}) (interface{}, error) {
+	if fun, ok := expr.Fun.(*ast.Ident); ok {
+		if _, ok := aggregates[fun.Name]; ok {
+			return nil, newError(fun.Pos(), ErrUnsupported, "aggregate %s needs a compiled program with history", fun.Name)
+		}
+		if _, ok := nullFuncs[fun.Name]; ok {
+			return evalNullFunc(expr, fun.Name, data)
+		}
+	}
+	name, f, err := lookupFunc(expr)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]Value, len(expr.Args))
+	types := make([]Type, len(expr.Args))
+	for i, arg := range expr.Args {
+		v, err := Eval(arg, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i], types[i] = valueOf(v), typeOf(v)
+	}
+	if err := f.check(expr, types); err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if t == Invalid {
+			return nil, nil
+		}
+	}
+	v, err := f.Call(args)
+	if err != nil {
+		return nil, callError(expr, name, err)
+	}
+	return v.interfaceOf(f.Result), nil
+}
+
+func mathFunc(fn func(x float64) float64) Func {
+	return Func{Args: []Type{Float}, Result: Float, Call: func(args []Value) (Value, error) {
+		return FloatValue(fn(args[0].Float())), nil
+	}}
+}
+
+func timeFunc(fn func(t time.Time) int) Func {
+	return Func{Args: []Type{Time}, Result: Int, Call: func(args []Value) (Value, error) {
+		return IntValue(int64(fn(args[0].Time()))), nil
+	}}
+}
+
+// builtin functions, times are in UTC
+func init() {
+	builtins := map[string]Func{
+		"abs":   mathFunc(math.Abs),
+		"sqrt":  mathFunc(math.Sqrt),
+		"log":   mathFunc(math.Log),
+		"round": mathFunc(math.Round),
+		"pow": {Args: []Type{Float, Float}, Result: Float, Call: func(args []Value) (Value, error) {
+			return FloatValue(math.Pow(args[0].Float(), args[1].Float())), nil
+		}},
+		"min": {Args: []Type{Float}, Variadic: true, Result: Float, Call: func(args []Value) (Value, error) {
+			m := args[0].Float()
+			for _, arg := range args[1:] {
+				m = math.Min(m, arg.Float())
+			}
+			return FloatValue(m), nil
+		}},
+		"max": {Args: []Type{Float}, Variadic: true, Result: Float, Call: func(args []Value) (Value, error) {
+			m := args[0].Float()
+			for _, arg := range args[1:] {
+				m = math.Max(m, arg.Float())
+			}
+			return FloatValue(m), nil
+		}},
+		"clamp": {Args: []Type{Float, Float, Float}, Result: Float, Call: func(args []Value) (Value, error) {
+			return FloatValue(math.Max(args[1].Float(), math.Min(args[2].Float(), args[0].Float()))), nil
+		}},
+		"isnan": {Args: []Type{Float}, Result: Bool, Call: func(args []Value) (Value, error) {
+			return BoolValue(math.IsNaN(args[0].Float())), nil
+		}},
+		// bounds are inclusive
+		"between": {Args: []Type{Float, Float, Float}, Result: Bool, Call: func(args []Value) (Value, error) {
+			x := args[0].Float()
+			return BoolValue(x >= args[1].Float() && x <= args[2].Float()), nil
+		}},
+		"hour":   timeFunc(func(t time.Time) int { return t.Hour() }),
+		"minute": timeFunc(func(t time.Time) int { return t.Minute() }),
+		// 0 is sunday
+		"weekday": timeFunc(func(t time.Time) int { return int(t.Weekday()) }),
+	}
+	for name, f := range builtins {
+		if err := Register(name, f); err != nil {
+			panic(err)
+		}
+	}
+}
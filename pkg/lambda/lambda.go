@@ -1,71 +1,188 @@
 package lambda
 
 import (
-	"errors"
-	"fmt"
 	"go/ast"
+	"go/parser"
+	"go/scanner"
 	"go/token"
+	"strconv"
 )
 
-func Eval(expr ast.Expr, data map[string]interface{}) interface{} {
+// Parse parses a go expression, positions of the expression are 1-based offsets in src
+func Parse(src string) (ast.Expr, error) {
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+			return nil, &Error{Pos: list[0].Pos.Offset + 1, Kind: ErrSyntax, Msg: list[0].Msg}
+		}
+		return nil, &Error{Kind: ErrSyntax, Msg: err.Error()}
+	}
+	return expr, nil
+}
 
+// Eval evaluates the expression with the values of identifiers in data.
+// Values are int64, float64, bool, string or time.Time, other integer and float
+// types in data are converted. Functions are the registered ones.
+// Errors are *Error, the kind of which is matched by errors.Is.
+//
+// Identifiers missing from data, nil and nil pointers are null, which is nil.
+// Operators and functions on null result in null, except && and || following
+// three-valued logic: false && null is false, true || null is true.
+func Eval(expr ast.Expr, data map[string]interface{}) (interface{}, error) {
 	switch expr := expr.(type) {
 	case *ast.BasicLit: // 匹配到数据
-		return getlitValue(expr)
+		return litValue(expr)
 	case *ast.BinaryExpr: // 匹配到子树
+		if expr.Op == token.LAND || expr.Op == token.LOR {
+			return evalLogical(expr, data)
+		}
 		// 后序遍历
-		x := Eval(expr.X, data) // 左子树结果
-		y := Eval(expr.Y, data) // 右子树结果
-		if x == nil || y == nil {
-			return errors.New(fmt.Sprintf("%+v, %+v is nil", x, y))
+		x, err := Eval(expr.X, data) // 左子树结果
+		if err != nil {
+			return nil, err
 		}
-		op := expr.Op // 运算符
-
-		// 按照不同类型执行运算
-		switch x.(type) {
-		case int64:
-			return calculateForInt(x, y, op)
-		case bool:
-			return calculateForBool(x, y, op)
-		case string:
-			return calculateForString(x, y, op)
-		case error:
-			return errors.New(fmt.Sprintf("%+v %+v %+v eval failed", x, op, y))
-		default:
-			return errors.New(fmt.Sprintf("%+v op is not support", op))
+		y, err := Eval(expr.Y, data) // 右子树结果
+		if err != nil {
+			return nil, err
+		}
+		return binaryOp(expr.OpPos, expr.Op, x, y)
+	case *ast.UnaryExpr:
+		x, err := Eval(expr.X, data)
+		if err != nil {
+			return nil, err
 		}
+		return unaryOp(expr.OpPos, expr.Op, x)
 	case *ast.CallExpr: // 匹配到函数
-		return calculateForFunc(expr.Fun.(*ast.Ident).Name, expr.Args, data)
+		return evalCall(expr, data)
 	case *ast.ParenExpr: // 匹配到括号
 		return Eval(expr.X, data)
 	case *ast.Ident: // 匹配到变量
-		fmt.Println("ident", expr.Name)
-		return data[expr.Name]
+		return identValue(expr, data)
 	default:
-		return errors.New(fmt.Sprintf("%x type is not support", expr))
+		return nil, newError(expr.Pos(), ErrUnsupported, "expression %T", expr)
 	}
 }
 
-func getlitValue(expr *ast.BasicLit) interface{} {
-	fmt.Println("getlitValue", expr.Value)
-	return nil
+// EvalBool evaluates the expression which must result in a bool, e.g. the condition of a rule
+func EvalBool(expr ast.Expr, data map[string]interface{}) (bool, error) {
+	v, err := Eval(expr, data)
+	if err != nil {
+		return false, err
+	}
+	if v == nil {
+		return false, errNull
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, newError(expr.Pos(), ErrType, "result is %s, not bool", typeOf(v))
+	}
+	return b, nil
 }
 
-func calculateForInt(x, y interface{}, op token.Token) int64 {
-	fmt.Println("calculateForInt", x, y, op)
-	return 0
+func litValue(expr *ast.BasicLit) (interface{}, error) {
+	switch expr.Kind {
+	case token.INT:
+		v, err := strconv.ParseInt(expr.Value, 0, 64)
+		if err != nil {
+			return nil, newError(expr.Pos(), ErrSyntax, "invalid int %s", expr.Value)
+		}
+		return v, nil
+	case token.FLOAT:
+		v, err := strconv.ParseFloat(expr.Value, 64)
+		if err != nil {
+			return nil, newError(expr.Pos(), ErrSyntax, "invalid float %s", expr.Value)
+		}
+		return v, nil
+	case token.STRING, token.CHAR:
+		v, err := strconv.Unquote(expr.Value)
+		if err != nil {
+			return nil, newError(expr.Pos(), ErrSyntax, "invalid string %s", expr.Value)
+		}
+		return v, nil
+	default:
+		return nil, newError(expr.Pos(), ErrUnsupported, "literal %s", expr.Value)
+	}
 }
 
-func calculateForBool(x, y interface{}, op token.Token) bool {
-	fmt.Println("calculateForBool", x, y, op)
-	return true
+// identValue returns the value of identifier in data, true and false are the
+// bool constants unless defined in data. Missing identifiers are null.
+func identValue(expr *ast.Ident, data map[string]interface{}) (interface{}, error) {
+	raw, ok := data[expr.Name]
+	if !ok {
+		switch expr.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, nil
+	}
+	v, ok := normalize(raw)
+	if !ok {
+		return nil, newError(expr.Pos(), ErrType, "unsupported value %T of %s", raw, expr.Name)
+	}
+	return v, nil
+}
+
+// evalLogical evaluates && and || with short circuit, operands must be bool or null.
+// The result is null only if it depends on a null operand.
+func evalLogical(expr *ast.BinaryExpr, data map[string]interface{}) (interface{}, error) {
+	x, err := evalOperand(expr.X, expr.Op, data)
+	if err != nil {
+		return nil, err
+	}
+	// false && y, true || y
+	if x != nil && x.(bool) == (expr.Op == token.LOR) {
+		return x, nil
+	}
+	y, err := evalOperand(expr.Y, expr.Op, data)
+	if err != nil {
+		return nil, err
+	}
+	if x == nil && y != nil && y.(bool) == (expr.Op == token.LOR) {
+		return y, nil
+	}
+	if x == nil {
+		return nil, nil
+	}
+	return y, nil
 }
 
-func calculateForString(x, y interface{}, op token.Token) string {
-	fmt.Println("calculateForString", x, y, op)
-	return ""
+func evalOperand(expr ast.Expr, op token.Token, data map[string]interface{}) (interface{}, error) {
+	v, err := Eval(expr, data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.(bool); !ok && v != nil {
+		return nil, newError(expr.Pos(), ErrType, "operator %s on %s", op, typeOf(v))
+	}
+	return v, nil
 }
 
-func calculateForFunc(name string, args []ast.Expr, data map[string]interface{}) interface{} {
-	return nil
+func unaryOp(pos token.Pos, op token.Token, x interface{}) (interface{}, error) {
+	if x == nil && (op == token.ADD || op == token.SUB || op == token.NOT) {
+		return nil, nil
+	}
+	switch op {
+	case token.ADD, token.SUB:
+		switch x := x.(type) {
+		case int64:
+			if op == token.SUB {
+				return -x, nil
+			}
+			return x, nil
+		case float64:
+			if op == token.SUB {
+				return -x, nil
+			}
+			return x, nil
+		}
+	case token.NOT:
+		if x, ok := x.(bool); ok {
+			return !x, nil
+		}
+	default:
+		return nil, newError(pos, ErrUnsupported, "operator %s", op)
+	}
+	return nil, newError(pos, ErrType, "operator %s on %s", op, typeOf(x))
 }
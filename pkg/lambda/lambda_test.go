@@ -1,30 +1,232 @@
 package lambda
 
 import (
-	"go/ast"
-	"go/parser"
+	"errors"
+	"math"
 	"testing"
+	"time"
 )
 
 func TestEval(t *testing.T) {
-	type args struct {
-		expr ast.Expr
-		data map[string]interface{}
-	}
-
-	expr := `a > threshold_lower &&  a < threshold_upper`
-	exprAst, err := parser.ParseExpr(expr)
-	if err != nil {
-		panic(err.Error())
-	}
-
 	data := map[string]interface{}{
 		"a":               1,
 		"b":               2,
 		"c":               3,
 		"threshold_lower": 0.0,
 		"threshold_upper": 2.0,
+		"name":            "sensor",
+		"enabled":         true,
+		"reading":         float32(1.5),
+	}
+
+	tests := []struct {
+		expr string
+		want interface{}
+		err  error
+	}{
+		{expr: `a > threshold_lower &&  a < threshold_upper`, want: true},
+		{expr: `a + b * c`, want: int64(7)},
+		{expr: `(a + b) * c`, want: int64(9)},
+		{expr: `c / b`, want: int64(1)},
+		{expr: `c % b`, want: int64(1)},
+		{expr: `c / 2.0`, want: 1.5},
+		{expr: `a + reading`, want: 2.5},
+		{expr: `-a + 0x10`, want: int64(15)},
+		{expr: `1e3 > 999`, want: true},
+		{expr: `name + "-01" == "sensor-01"`, want: true},
+		{expr: `name < "t"`, want: true},
+		{expr: `!enabled || a == 1`, want: true},
+		{expr: `enabled != false`, want: true},
+		{expr: `a > 1 && unknown > 0`, want: false},
+		{expr: `a / 0`, err: ErrDivByZero},
+		{expr: `a % 1.5`, err: ErrType},
+		{expr: `a + name`, err: ErrType},
+		{expr: `a && enabled`, err: ErrType},
+		{expr: `-name`, err: ErrType},
+		{expr: `a > unknown`, want: nil},
+		{expr: `a << 1`, err: ErrUnsupported},
+		{expr: `data[0]`, err: ErrUnsupported},
+		{expr: `a >`, err: ErrSyntax},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.expr)
+		if err == nil {
+			_, err = Eval(expr, data)
+		}
+		if tt.err != nil {
+			var e *Error
+			if !errors.Is(err, tt.err) || !errors.As(err, &e) || e.Pos == 0 {
+				t.Errorf("%s: error = %v, want %v", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got, _ := Eval(expr, data); got != tt.want {
+			t.Errorf("%s = %v (%T), want %v (%T)", tt.expr, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestEvalFloat(t *testing.T) {
+	expr, _ := Parse(`x / 0.0`)
+	v, err := Eval(expr, map[string]interface{}{"x": 1.0})
+	if err != nil || !math.IsInf(v.(float64), 1) {
+		t.Errorf("x / 0.0 = %v, %v", v, err)
 	}
 
-	Eval(exprAst, data)
+	expr, _ = Parse(`x + 1`)
+	if _, err := EvalBool(expr, map[string]interface{}{"x": 1.0}); !errors.Is(err, ErrType) {
+		t.Errorf("error = %v, want type mismatch", err)
+	}
+	if _, err := Eval(expr, map[string]interface{}{"x": []int{1}}); !errors.Is(err, ErrType) {
+		t.Errorf("error = %v, want type mismatch", err)
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	data := map[string]interface{}{
+		"temp": 21.5,
+		"lo":   18,
+		"hi":   26,
+		"time": time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC), // sunday
+		"n":    -4,
+	}
+	tests := []struct {
+		expr string
+		want interface{}
+		err  error
+	}{
+		{expr: `between(temp, lo, hi) && hour(time) >= 8`, want: true},
+		{expr: `weekday(time) == 0 && minute(time) == 30`, want: true},
+		{expr: `abs(n) + sqrt(16)`, want: 8.0},
+		{expr: `min(temp, lo, 30) + max(1, 2)`, want: 20.0},
+		{expr: `pow(2, 10)`, want: 1024.0},
+		{expr: `round(log(100) / log(10))`, want: 2.0},
+		{expr: `clamp(temp, 0, hi - 5)`, want: 21.0},
+		{expr: `isnan(sqrt(n))`, want: true},
+		{expr: `double(temp) > 40`, want: true},
+		{expr: `fail(temp)`, err: ErrCall},
+		{expr: `between(temp, lo)`, err: ErrType},
+		{expr: `hour(temp)`, err: ErrType},
+		{expr: `min()`, err: ErrType},
+		{expr: `median(temp)`, err: ErrUndefined},
+	}
+
+	if err := Register("double", Func{Args: []Type{Float}, Result: Float, Call: func(args []Value) (Value, error) {
+		return FloatValue(args[0].Float() * 2), nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("fail", Func{Args: []Type{Float}, Result: Float, Call: func(args []Value) (Value, error) {
+		return Value{}, errors.New("always fails")
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("bad name", Func{Result: Float, Call: func([]Value) (Value, error) { return Value{}, nil }}); err == nil {
+		t.Error("function with invalid name registered")
+	}
+
+	schema := Schema{"temp": Float, "lo": Int, "hi": Int, "time": Time, "n": Int}
+	for _, tt := range tests {
+		expr, _ := Parse(tt.expr)
+		got, err := Eval(expr, data)
+
+		// the compiled program has the same result
+		p, compileErr := Compile(tt.expr, schema)
+		if compileErr == nil {
+			vars := p.NewVars()
+			for name, v := range data {
+				if slot, ok := p.Slot(name); ok {
+					vars.Set(slot, v)
+				}
+			}
+			got2, runErr := p.Run(vars)
+			if runErr != nil {
+				compileErr = runErr
+			} else if got2 != got {
+				t.Errorf("%s: program = %v, eval = %v", tt.expr, got2, got)
+			}
+		}
+
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) || !errors.Is(compileErr, tt.err) {
+				t.Errorf("%s: error = %v and %v, want %v", tt.expr, err, compileErr, tt.err)
+			}
+			continue
+		}
+		if err != nil || compileErr != nil {
+			t.Errorf("%s: %v, %v", tt.expr, err, compileErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestNull(t *testing.T) {
+	value := 2.5
+	data := map[string]interface{}{
+		"a":       &value,
+		"missing": (*float64)(nil),
+		"ok":      true,
+	}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{expr: `a > 1`, want: true},
+		{expr: `missing > 1`, want: nil},
+		{expr: `-missing + 1`, want: nil},
+		{expr: `!(missing > 1)`, want: nil},
+		{expr: `abs(missing)`, want: nil},
+		{expr: `missing > 1 && false`, want: false},
+		{expr: `missing > 1 && true`, want: nil},
+		{expr: `missing > 1 || ok`, want: true},
+		{expr: `!ok || missing > 1`, want: nil},
+		{expr: `exists(missing) || exists(a)`, want: true},
+		{expr: `coalesce(missing, 0) + coalesce(a, 0)`, want: 2.5},
+		{expr: `coalesce(missing, missing)`, want: nil},
+	}
+	schema := Schema{"a": Float, "missing": Float, "ok": Bool}
+	for _, tt := range tests {
+		expr, _ := Parse(tt.expr)
+		got, err := Eval(expr, data)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v, want %v", tt.expr, got, err, tt.want)
+		}
+
+		p, err := Compile(tt.expr, schema)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		vars := p.NewVars()
+		for name, v := range data {
+			if slot, ok := p.Slot(name); ok {
+				if err := vars.Set(slot, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if got, err := p.Run(vars); err != nil || got != tt.want {
+			t.Errorf("%s: program = %v, %v, want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	expr, _ := Parse(`missing > 1`)
+	if _, err := EvalBool(expr, data); !errors.Is(err, ErrNull) {
+		t.Errorf("error = %v, want null result", err)
+	}
+	if _, err := Compile(`coalesce(a, "none")`, schema); !errors.Is(err, ErrType) {
+		t.Errorf("error = %v, want type mismatch", err)
+	}
+	if _, err := Compile(`exists(a, 1)`, schema); !errors.Is(err, ErrType) {
+		t.Errorf("error = %v, want type mismatch", err)
+	}
+	if err := Register("coalesce", Func{Args: []Type{Float}, Result: Float, Call: func([]Value) (Value, error) { return Value{}, nil }}); err == nil {
+		t.Error("coalesce replaced")
+	}
 }
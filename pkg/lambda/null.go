@@ -0,0 +1,65 @@
+package lambda
+
+import (
+	"go/ast"
+)
+
+// functions on null values, the arguments are not required to be non-null:
+// exists(x) is whether x is not null, coalesce(x, d) is d when x is null
+var nullFuncs = map[string]int{
+	"exists":   1,
+	"coalesce": 2,
+}
+
+func evalNullFunc(expr *ast.CallExpr, name string, data map[string]interface{}) (interface{}, error) {
+	if len(expr.Args) != nullFuncs[name] {
+		return nil, newError(expr.Lparen, ErrType, "%s takes %d arguments, %d given", name, nullFuncs[name], len(expr.Args))
+	}
+	x, err := Eval(expr.Args[0], data)
+	if err != nil {
+		return nil, err
+	}
+	if name == "exists" {
+		return x != nil, nil
+	}
+	if x != nil {
+		return x, nil
+	}
+	return Eval(expr.Args[1], data)
+}
+
+// nullFunc compiles exists and coalesce, both arguments of coalesce must be the same
+// type, ints are promoted when mixed with floats
+func (c *compiler) nullFunc(expr *ast.CallExpr, name string) (evalFunc, Type, error) {
+	if len(expr.Args) != nullFuncs[name] {
+		return nil, Invalid, newError(expr.Lparen, ErrType, "%s takes %d arguments, %d given", name, nullFuncs[name], len(expr.Args))
+	}
+	x, xt, err := c.compile(expr.Args[0])
+	if err != nil {
+		return nil, Invalid, err
+	}
+	if name == "exists" {
+		return func(vars *Vars) (Value, error) {
+			v, err := x(vars)
+			return BoolValue(!v.null), err
+		}, Bool, nil
+	}
+
+	d, dt, err := c.compile(expr.Args[1])
+	if err != nil {
+		return nil, Invalid, err
+	}
+	typ := xt
+	if (xt == Int && dt == Float) || (xt == Float && dt == Int) {
+		typ = Float
+	} else if xt != dt {
+		return nil, Invalid, newError(expr.Args[1].Pos(), ErrType, "default of coalesce is %s, not %s", dt, xt)
+	}
+	return func(vars *Vars) (Value, error) {
+		v, err := x(vars)
+		if err != nil || !v.null {
+			return v, err
+		}
+		return d(vars)
+	}, typ, nil
+}
@@ -0,0 +1,485 @@
+package lambda
+
+import (
+	"go/ast"
+	"go/token"
+	"math"
+	"time"
+)
+
+// Schema : types of the identifiers could be used by an expression
+type Schema map[string]Type
+
+// evalFunc evaluates a compiled node
+type evalFunc func(vars *Vars) (Value, error)
+
+// Program : an expression compiled once and evaluated many times. Identifiers and
+// types of operands are checked on compile, so evaluation only fails on runtime
+// errors such as integer division by zero. A program is safe for concurrent use,
+// each goroutine evaluates with its own Vars.
+type Program struct {
+	src   string
+	typ   Type
+	eval  evalFunc
+	slots map[string]int
+	types []Type
+	// number of arguments of all calls
+	scratch int
+	// slots of the fields referenced by aggregates, with the number of samples
+	// to keep for them besides the windows
+	fields  []int
+	keep    []int
+	windows []windowSpec
+}
+
+// Vars : values of the identifiers of a program, indexed by slot. Vars are reused
+// across evaluations to avoid allocation.
+type Vars struct {
+	values []Value
+	types  []Type
+	// arguments of calls, each call has its own range
+	scratch []Value
+	// history of the series for aggregates
+	series *Series
+}
+
+// compiler resolves identifiers to slots while compiling
+type compiler struct {
+	schema  Schema
+	slots   map[string]int
+	types   []Type
+	scratch int
+	fields  []int
+	keep    []int
+	windows []windowSpec
+}
+
+// Compile parses and type checks the expression with the identifiers of schema.
+// Errors are *Error positioned in src.
+func Compile(src string, schema Schema) (*Program, error) {
+	expr, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{schema: schema, slots: make(map[string]int)}
+	eval, typ, err := c.compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{
+		src:     src,
+		typ:     typ,
+		eval:    eval,
+		slots:   c.slots,
+		types:   c.types,
+		scratch: c.scratch,
+		fields:  c.fields,
+		keep:    c.keep,
+		windows: c.windows,
+	}, nil
+}
+
+// Source returns the source of the program
+func (p *Program) Source() string {
+	return p.src
+}
+
+// Type returns the type of the result
+func (p *Program) Type() Type {
+	return p.typ
+}
+
+// Slot returns the slot of an identifier, false if it is not used by the program
+func (p *Program) Slot(name string) (int, bool) {
+	slot, ok := p.slots[name]
+	return slot, ok
+}
+
+// NewVars returns the values of the identifiers of the program, which are null until set
+func (p *Program) NewVars() *Vars {
+	vars := &Vars{values: make([]Value, len(p.types)), types: p.types, scratch: make([]Value, p.scratch)}
+	vars.Reset()
+	return vars
+}
+
+// Run evaluates the program, the result is int64, float64, bool, string or time.Time,
+// nil when null
+func (p *Program) Run(vars *Vars) (interface{}, error) {
+	v, err := p.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return v.interfaceOf(p.typ), nil
+}
+
+// Bool evaluates a program resulting in a bool, e.g. the condition of a rule.
+// ErrNull is returned when the result is null.
+func (p *Program) Bool(vars *Vars) (bool, error) {
+	if p.typ != Bool {
+		return false, newError(token.NoPos, ErrType, "result is %s, not bool", p.typ)
+	}
+	v, err := p.eval(vars)
+	if err == nil && v.null {
+		return false, errNull
+	}
+	return v.b, err
+}
+
+// Float evaluates a program resulting in a number, ints are converted.
+// ErrNull is returned when the result is null.
+func (p *Program) Float(vars *Vars) (float64, error) {
+	if p.typ != Int && p.typ != Float {
+		return 0, newError(token.NoPos, ErrType, "result is %s, not number", p.typ)
+	}
+	v, err := p.eval(vars)
+	if err == nil && v.null {
+		return math.NaN(), errNull
+	}
+	if p.typ == Int {
+		return float64(v.i), err
+	}
+	return v.f, err
+}
+
+// Reset sets all slots to null
+func (v *Vars) Reset() {
+	for i := range v.values {
+		v.values[i] = NullValue()
+	}
+}
+
+// SetNull sets a slot to null, for missing data
+func (v *Vars) SetNull(slot int) {
+	v.values[slot] = NullValue()
+}
+
+// SetInt sets an int slot, ints could also be set to float slots
+func (v *Vars) SetInt(slot int, x int64) {
+	v.values[slot] = IntValue(x)
+}
+
+// SetFloat sets a float slot
+func (v *Vars) SetFloat(slot int, x float64) {
+	v.values[slot] = FloatValue(x)
+}
+
+// SetBool sets a bool slot
+func (v *Vars) SetBool(slot int, x bool) {
+	v.values[slot] = BoolValue(x)
+}
+
+// SetString sets a string slot
+func (v *Vars) SetString(slot int, x string) {
+	v.values[slot] = StringValue(x)
+}
+
+// SetTime sets a time slot
+func (v *Vars) SetTime(slot int, x time.Time) {
+	v.values[slot] = TimeValue(x)
+}
+
+// Set sets a slot with a go value, which is converted as Eval does
+func (v *Vars) Set(slot int, x interface{}) error {
+	n, ok := normalize(x)
+	if !ok {
+		return newError(token.NoPos, ErrType, "unsupported value %T", x)
+	}
+	switch n := n.(type) {
+	case nil:
+		v.SetNull(slot)
+		return nil
+	case int64:
+		if v.types[slot] == Int || v.types[slot] == Float {
+			v.SetInt(slot, n)
+			return nil
+		}
+	case float64:
+		if v.types[slot] == Float {
+			v.SetFloat(slot, n)
+			return nil
+		}
+	case bool:
+		if v.types[slot] == Bool {
+			v.SetBool(slot, n)
+			return nil
+		}
+	case string:
+		if v.types[slot] == String {
+			v.SetString(slot, n)
+			return nil
+		}
+	case time.Time:
+		if v.types[slot] == Time {
+			v.SetTime(slot, n)
+			return nil
+		}
+	}
+	return newError(token.NoPos, ErrType, "cannot set %s to %s slot", typeOf(n), v.types[slot])
+}
+
+func (c *compiler) compile(expr ast.Expr) (evalFunc, Type, error) {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		v, err := litValue(expr)
+		if err != nil {
+			return nil, Invalid, err
+		}
+		return constant(v)
+	case *ast.Ident:
+		return c.ident(expr)
+	case *ast.ParenExpr:
+		return c.compile(expr.X)
+	case *ast.UnaryExpr:
+		return c.unary(expr)
+	case *ast.BinaryExpr:
+		return c.binary(expr)
+	case *ast.CallExpr:
+		return c.call(expr)
+	default:
+		return nil, Invalid, newError(expr.Pos(), ErrUnsupported, "expression %T", expr)
+	}
+}
+
+// constant returns the node of a normalized value
+func constant(v interface{}) (evalFunc, Type, error) {
+	c := valueOf(v)
+	return func(*Vars) (Value, error) { return c, nil }, typeOf(v), nil
+}
+
+func (c *compiler) ident(expr *ast.Ident) (evalFunc, Type, error) {
+	typ, ok := c.schema[expr.Name]
+	if !ok {
+		switch expr.Name {
+		case "true":
+			return constant(true)
+		case "false":
+			return constant(false)
+		}
+		return nil, Invalid, newError(expr.Pos(), ErrUndefined, "identifier %s", expr.Name)
+	}
+	slot, ok := c.slots[expr.Name]
+	if !ok {
+		slot = len(c.types)
+		c.slots[expr.Name] = slot
+		c.types = append(c.types, typ)
+	}
+	return func(vars *Vars) (Value, error) { return vars.values[slot], nil }, typ, nil
+}
+
+func (c *compiler) unary(expr *ast.UnaryExpr) (evalFunc, Type, error) {
+	x, typ, err := c.compile(expr.X)
+	if err != nil {
+		return nil, Invalid, err
+	}
+	switch {
+	case expr.Op == token.ADD && (typ == Int || typ == Float):
+		return x, typ, nil
+	case expr.Op == token.SUB && typ == Int:
+		return func(vars *Vars) (Value, error) {
+			v, err := x(vars)
+			return Value{i: -v.i, f: -v.f, null: v.null}, err
+		}, Int, nil
+	case expr.Op == token.SUB && typ == Float:
+		return func(vars *Vars) (Value, error) {
+			v, err := x(vars)
+			return Value{f: -v.f, null: v.null}, err
+		}, Float, nil
+	case expr.Op == token.NOT && typ == Bool:
+		return func(vars *Vars) (Value, error) {
+			v, err := x(vars)
+			return Value{b: !v.b, null: v.null}, err
+		}, Bool, nil
+	case expr.Op != token.ADD && expr.Op != token.SUB && expr.Op != token.NOT:
+		return nil, Invalid, newError(expr.OpPos, ErrUnsupported, "operator %s", expr.Op)
+	}
+	return nil, Invalid, newError(expr.OpPos, ErrType, "operator %s on %s", expr.Op, typ)
+}
+
+func (c *compiler) binary(expr *ast.BinaryExpr) (evalFunc, Type, error) {
+	if !supported(expr.Op) {
+		return nil, Invalid, newError(expr.OpPos, ErrUnsupported, "operator %s", expr.Op)
+	}
+	x, xt, err := c.compile(expr.X)
+	if err != nil {
+		return nil, Invalid, err
+	}
+	y, yt, err := c.compile(expr.Y)
+	if err != nil {
+		return nil, Invalid, err
+	}
+
+	if expr.Op == token.LAND || expr.Op == token.LOR {
+		if xt != Bool {
+			return nil, Invalid, newError(expr.X.Pos(), ErrType, "operator %s on %s", expr.Op, xt)
+		}
+		if yt != Bool {
+			return nil, Invalid, newError(expr.Y.Pos(), ErrType, "operator %s on %s", expr.Op, yt)
+		}
+		return logical(expr.Op, x, y), Bool, nil
+	}
+
+	// ints are promoted to floats when mixed with floats, value.f of ints is always set
+	typ := xt
+	if (xt == Int && yt == Float) || (xt == Float && yt == Int) {
+		typ = Float
+	} else if xt != yt {
+		return nil, Invalid, newError(expr.OpPos, ErrType, "operator %s on %s and %s", expr.Op, xt, yt)
+	}
+	var op func(x, y Value) (Value, bool)
+	switch typ {
+	case Int:
+		op = intOps[expr.Op]
+	case Float:
+		op = floatOps[expr.Op]
+	case String:
+		op = stringOps[expr.Op]
+	case Bool:
+		op = boolOps[expr.Op]
+	}
+	if op == nil {
+		return nil, Invalid, newError(expr.OpPos, ErrType, "operator %s on %s", expr.Op, typ)
+	}
+
+	resultType := typ
+	switch expr.Op {
+	case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+		resultType = Bool
+	}
+	pos, tok := expr.OpPos, expr.Op
+	return func(vars *Vars) (Value, error) {
+		a, err := x(vars)
+		if err != nil {
+			return Value{}, err
+		}
+		b, err := y(vars)
+		if err != nil {
+			return Value{}, err
+		}
+		if a.null || b.null {
+			return NullValue(), nil
+		}
+		v, ok := op(a, b)
+		if !ok {
+			return Value{}, newError(pos, ErrDivByZero, "integer %s by zero", tok)
+		}
+		return v, nil
+	}, resultType, nil
+}
+
+// logical evaluates && and || with short circuit, following three-valued logic
+// the result is null only if it depends on a null operand
+func logical(op token.Token, x, y evalFunc) evalFunc {
+	or := op == token.LOR
+	return func(vars *Vars) (Value, error) {
+		a, err := x(vars)
+		if err != nil || (!a.null && a.b == or) {
+			return a, err
+		}
+		b, err := y(vars)
+		if err != nil || !a.null || (!b.null && b.b == or) {
+			return b, err
+		}
+		return NullValue(), nil
+	}
+}
+
+// call compiles a function call, arguments are evaluated into the scratch of vars
+func (c *compiler) call(expr *ast.CallExpr) (evalFunc, Type, error) {
+	if fun, ok := expr.Fun.(*ast.Ident); ok {
+		if _, ok := aggregates[fun.Name]; ok {
+			return c.aggregate(expr, fun.Name)
+		}
+		if _, ok := nullFuncs[fun.Name]; ok {
+			return c.nullFunc(expr, fun.Name)
+		}
+	}
+	name, f, err := lookupFunc(expr)
+	if err != nil {
+		return nil, Invalid, err
+	}
+	args := make([]evalFunc, len(expr.Args))
+	types := make([]Type, len(expr.Args))
+	for i, arg := range expr.Args {
+		if args[i], types[i], err = c.compile(arg); err != nil {
+			return nil, Invalid, err
+		}
+	}
+	if err := f.check(expr, types); err != nil {
+		return nil, Invalid, err
+	}
+
+	base := c.scratch
+	c.scratch += len(args)
+	return func(vars *Vars) (Value, error) {
+		buf := vars.scratch[base : base+len(args)]
+		for i, arg := range args {
+			v, err := arg(vars)
+			if err != nil {
+				return Value{}, err
+			}
+			buf[i] = v
+		}
+		for _, v := range buf {
+			if v.null {
+				return NullValue(), nil
+			}
+		}
+		v, err := f.Call(buf)
+		if err != nil {
+			return Value{}, callError(expr, name, err)
+		}
+		return v, nil
+	}, f.Result, nil
+}
+
+// operators of the compiled expressions, false is returned on integer division by zero
+var (
+	intOps = map[token.Token]func(x, y Value) (Value, bool){
+		token.ADD: func(x, y Value) (Value, bool) { return IntValue(x.i + y.i), true },
+		token.SUB: func(x, y Value) (Value, bool) { return IntValue(x.i - y.i), true },
+		token.MUL: func(x, y Value) (Value, bool) { return IntValue(x.i * y.i), true },
+		token.QUO: func(x, y Value) (Value, bool) {
+			if y.i == 0 {
+				return Value{}, false
+			}
+			return IntValue(x.i / y.i), true
+		},
+		token.REM: func(x, y Value) (Value, bool) {
+			if y.i == 0 {
+				return Value{}, false
+			}
+			return IntValue(x.i % y.i), true
+		},
+		token.EQL: func(x, y Value) (Value, bool) { return Value{b: x.i == y.i}, true },
+		token.NEQ: func(x, y Value) (Value, bool) { return Value{b: x.i != y.i}, true },
+		token.LSS: func(x, y Value) (Value, bool) { return Value{b: x.i < y.i}, true },
+		token.LEQ: func(x, y Value) (Value, bool) { return Value{b: x.i <= y.i}, true },
+		token.GTR: func(x, y Value) (Value, bool) { return Value{b: x.i > y.i}, true },
+		token.GEQ: func(x, y Value) (Value, bool) { return Value{b: x.i >= y.i}, true },
+	}
+	floatOps = map[token.Token]func(x, y Value) (Value, bool){
+		token.ADD: func(x, y Value) (Value, bool) { return Value{f: x.f + y.f}, true },
+		token.SUB: func(x, y Value) (Value, bool) { return Value{f: x.f - y.f}, true },
+		token.MUL: func(x, y Value) (Value, bool) { return Value{f: x.f * y.f}, true },
+		token.QUO: func(x, y Value) (Value, bool) { return Value{f: x.f / y.f}, true },
+		token.EQL: func(x, y Value) (Value, bool) { return Value{b: x.f == y.f}, true },
+		token.NEQ: func(x, y Value) (Value, bool) { return Value{b: x.f != y.f}, true },
+		token.LSS: func(x, y Value) (Value, bool) { return Value{b: x.f < y.f}, true },
+		token.LEQ: func(x, y Value) (Value, bool) { return Value{b: x.f <= y.f}, true },
+		token.GTR: func(x, y Value) (Value, bool) { return Value{b: x.f > y.f}, true },
+		token.GEQ: func(x, y Value) (Value, bool) { return Value{b: x.f >= y.f}, true },
+	}
+	stringOps = map[token.Token]func(x, y Value) (Value, bool){
+		token.ADD: func(x, y Value) (Value, bool) { return Value{s: x.s + y.s}, true },
+		token.EQL: func(x, y Value) (Value, bool) { return Value{b: x.s == y.s}, true },
+		token.NEQ: func(x, y Value) (Value, bool) { return Value{b: x.s != y.s}, true },
+		token.LSS: func(x, y Value) (Value, bool) { return Value{b: x.s < y.s}, true },
+		token.LEQ: func(x, y Value) (Value, bool) { return Value{b: x.s <= y.s}, true },
+		token.GTR: func(x, y Value) (Value, bool) { return Value{b: x.s > y.s}, true },
+		token.GEQ: func(x, y Value) (Value, bool) { return Value{b: x.s >= y.s}, true },
+	}
+	boolOps = map[token.Token]func(x, y Value) (Value, bool){
+		token.EQL: func(x, y Value) (Value, bool) { return Value{b: x.b == y.b}, true },
+		token.NEQ: func(x, y Value) (Value, bool) { return Value{b: x.b != y.b}, true },
+	}
+)
@@ -0,0 +1,164 @@
+package lambda
+
+import (
+	"errors"
+	"testing"
+)
+
+var ruleSchema = Schema{
+	"a":               Int,
+	"b":               Int,
+	"threshold_lower": Float,
+	"threshold_upper": Float,
+	"name":            String,
+	"enabled":         Bool,
+}
+
+var ruleData = map[string]interface{}{
+	"a":               1,
+	"b":               2,
+	"threshold_lower": 0.0,
+	"threshold_upper": 2.0,
+	"name":            "sensor",
+	"enabled":         true,
+}
+
+const benchmarkRule = `a > threshold_lower && a < threshold_upper && b * 2.5 >= threshold_upper - 10`
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		expr string
+		typ  Type
+		pos  int
+		err  error
+	}{
+		{expr: `a > threshold_lower &&  a < threshold_upper`, typ: Bool},
+		{expr: `a + b * 2`, typ: Int},
+		{expr: `-a / 2.0`, typ: Float},
+		{expr: `name + "-01"`, typ: String},
+		{expr: `!enabled || false`, typ: Bool},
+		{expr: `a > unknown`, pos: 5, err: ErrUndefined},
+		{expr: `a + name`, pos: 3, err: ErrType},
+		{expr: `a && enabled`, pos: 1, err: ErrType},
+		{expr: `threshold_lower % 2`, pos: 17, err: ErrType},
+		{expr: `a << 1`, pos: 3, err: ErrUnsupported},
+		{expr: `a > `, pos: 5, err: ErrSyntax},
+	}
+	for _, tt := range tests {
+		p, err := Compile(tt.expr, ruleSchema)
+		if tt.err != nil {
+			var e *Error
+			if !errors.As(err, &e) || !errors.Is(err, tt.err) || e.Pos != tt.pos {
+				t.Errorf("%s: error = %v, want %v at %d", tt.expr, err, tt.err, tt.pos)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if p.Type() != tt.typ {
+			t.Errorf("%s: type = %s, want %s", tt.expr, p.Type(), tt.typ)
+		}
+
+		// the same result as the tree walker
+		vars := p.NewVars()
+		for name, v := range ruleData {
+			if slot, ok := p.Slot(name); ok {
+				if err := vars.Set(slot, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		got, err := p.Run(vars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		expr, _ := Parse(tt.expr)
+		want, _ := Eval(expr, ruleData)
+		if got != want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, want)
+		}
+	}
+}
+
+func TestProgramRuntimeError(t *testing.T) {
+	p, err := Compile(`a / b > 1`, ruleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.NewVars()
+	slot, _ := p.Slot("a")
+	vars.SetInt(slot, 1)
+	if _, err := p.Bool(vars); !errors.Is(err, ErrNull) {
+		t.Errorf("error = %v, want null result of missing b", err)
+	}
+	b, _ := p.Slot("b")
+	vars.SetInt(b, 0)
+	if _, err := p.Bool(vars); !errors.Is(err, ErrDivByZero) {
+		t.Errorf("error = %v, want division by zero", err)
+	}
+	if err := vars.Set(slot, "x"); !errors.Is(err, ErrType) {
+		t.Errorf("error = %v, want type mismatch", err)
+	}
+	if _, err := p.Float(vars); !errors.Is(err, ErrType) {
+		t.Errorf("error = %v, want type mismatch", err)
+	}
+}
+
+func TestProgramAllocs(t *testing.T) {
+	p, err := Compile(benchmarkRule, ruleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.NewVars()
+	for name, v := range ruleData {
+		if slot, ok := p.Slot(name); ok {
+			vars.Set(slot, v)
+		}
+	}
+	slot, _ := p.Slot("a")
+	allocs := testing.AllocsPerRun(100, func() {
+		vars.SetInt(slot, 1)
+		if _, err := p.Bool(vars); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("allocs = %v, want 0", allocs)
+	}
+}
+
+func BenchmarkEval(b *testing.B) {
+	expr, err := Parse(benchmarkRule)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := EvalBool(expr, ruleData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgram(b *testing.B) {
+	p, err := Compile(benchmarkRule, ruleSchema)
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := p.NewVars()
+	for name, v := range ruleData {
+		if slot, ok := p.Slot(name); ok {
+			vars.Set(slot, v)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Bool(vars); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package lambda
+
+import (
+	"errors"
+	"fmt"
+)
+
+// policies of rules whose condition is null because of missing inputs
+const (
+	MissingFalse  = "false"   // the condition is false
+	MissingSkip   = "skip"    // the point is skipped, the state of the rule is kept
+	MissingNoData = "no_data" // a no data alert is fired
+)
+
+// outcomes of evaluating a rule
+type Outcome int
+
+const (
+	OutcomeOK     Outcome = iota // condition is false
+	OutcomeFire                  // condition is true
+	OutcomeSkip                  // condition is null, skipped by policy
+	OutcomeNoData                // condition is null, no data alert by policy
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeOK:
+		return "ok"
+	case OutcomeFire:
+		return "fire"
+	case OutcomeSkip:
+		return "skip"
+	default:
+		return "no_data"
+	}
+}
+
+// Rule : condition of an alert rule compiled with its policy for missing inputs.
+// Missing inputs only affect the outcome when the condition depends on them,
+// e.g. "a > 1 || b > 1" is true when a is 2 and b is missing.
+type Rule struct {
+	*Program
+	Missing string
+}
+
+// NewRule compiles the condition of a rule, which must result in a bool
+func NewRule(src string, schema Schema, missing string) (*Rule, error) {
+	switch missing {
+	case MissingFalse, MissingSkip, MissingNoData:
+	default:
+		return nil, fmt.Errorf("lambda: unsupported missing data policy %q", missing)
+	}
+	p, err := Compile(src, schema)
+	if err != nil {
+		return nil, err
+	}
+	if p.Type() != Bool {
+		return nil, &Error{Pos: 1, Kind: ErrType, Msg: fmt.Sprintf("condition is %s, not bool", p.Type())}
+	}
+	return &Rule{Program: p, Missing: missing}, nil
+}
+
+// Evaluate evaluates the condition, null is resolved by the missing data policy
+func (r *Rule) Evaluate(vars *Vars) (Outcome, error) {
+	ok, err := r.Bool(vars)
+	if errors.Is(err, ErrNull) {
+		switch r.Missing {
+		case MissingSkip:
+			return OutcomeSkip, nil
+		case MissingNoData:
+			return OutcomeNoData, nil
+		default:
+			return OutcomeOK, nil
+		}
+	}
+	if err != nil {
+		return OutcomeOK, err
+	}
+	if ok {
+		return OutcomeFire, nil
+	}
+	return OutcomeOK, nil
+}
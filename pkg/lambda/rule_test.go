@@ -0,0 +1,42 @@
+package lambda
+
+import "testing"
+
+func TestRule(t *testing.T) {
+	schema := Schema{"temp": Float, "humidity": Float}
+	if _, err := NewRule(`temp + 1`, schema, MissingFalse); err == nil {
+		t.Error("rule of float condition compiled")
+	}
+	if _, err := NewRule(`temp > 30`, schema, "ignore"); err == nil {
+		t.Error("rule of unknown policy compiled")
+	}
+
+	tests := []struct {
+		missing  string
+		temp     interface{}
+		humidity interface{}
+		want     Outcome
+	}{
+		{missing: MissingFalse, temp: 35.0, humidity: 50.0, want: OutcomeFire},
+		{missing: MissingFalse, temp: 20.0, humidity: 50.0, want: OutcomeOK},
+		// the condition does not depend on the missing humidity
+		{missing: MissingNoData, temp: 35.0, humidity: nil, want: OutcomeFire},
+		{missing: MissingFalse, temp: nil, humidity: 50.0, want: OutcomeOK},
+		{missing: MissingSkip, temp: nil, humidity: 50.0, want: OutcomeSkip},
+		{missing: MissingNoData, temp: nil, humidity: nil, want: OutcomeNoData},
+	}
+	for _, tt := range tests {
+		r, err := NewRule(`temp > 30 || humidity > 90`, schema, tt.missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars := r.NewVars()
+		temp, _ := r.Slot("temp")
+		humidity, _ := r.Slot("humidity")
+		vars.Set(temp, tt.temp)
+		vars.Set(humidity, tt.humidity)
+		if got, err := r.Evaluate(vars); err != nil || got != tt.want {
+			t.Errorf("%s %v %v: outcome = %s, %v, want %s", tt.missing, tt.temp, tt.humidity, got, err, tt.want)
+		}
+	}
+}
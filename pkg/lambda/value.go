@@ -0,0 +1,360 @@
+package lambda
+
+import (
+	"go/token"
+	"math"
+	"time"
+)
+
+// Type : type of values of expressions
+type Type int
+
+const (
+	Invalid Type = iota
+	Int          // int64
+	Float        // float64
+	Bool         // bool
+	String       // string
+	Time         // time.Time
+)
+
+func (t Type) String() string {
+	switch t {
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Bool:
+		return "bool"
+	case String:
+		return "string"
+	case Time:
+		return "time"
+	default:
+		return "invalid"
+	}
+}
+
+// typeOf returns the type of a normalized value
+func typeOf(v interface{}) Type {
+	switch v.(type) {
+	case int64:
+		return Int
+	case float64:
+		return Float
+	case bool:
+		return Bool
+	case string:
+		return String
+	case time.Time:
+		return Time
+	default:
+		return Invalid
+	}
+}
+
+// normalize converts a go value to a value of expressions, integers are int64 and
+// floats are float64. Nil and nil pointers are null, which is nil.
+// False is returned for unsupported types.
+func normalize(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case *float64:
+		if v == nil {
+			return nil, true
+		}
+		return *v, true
+	case *int64:
+		if v == nil {
+			return nil, true
+		}
+		return *v, true
+	case *bool:
+		if v == nil {
+			return nil, true
+		}
+		return *v, true
+	case *string:
+		if v == nil {
+			return nil, true
+		}
+		return *v, true
+	case int64, float64, bool, string:
+		return v, true
+	case time.Time:
+		return v.UTC(), true
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return float64(v), true
+		}
+		return int64(v), true
+	case float32:
+		return float64(v), true
+	default:
+		return nil, false
+	}
+}
+
+// Value : argument or result of functions, the type of which is known on compile.
+// Ints are also readable as floats, so they could be passed as float arguments.
+type Value struct {
+	i    int64 // int, or unix nanoseconds of time
+	f    float64
+	b    bool
+	s    string
+	null bool
+}
+
+// NullValue returns the null value of missing data
+func NullValue() Value {
+	return Value{null: true}
+}
+
+func IntValue(x int64) Value {
+	return Value{i: x, f: float64(x)}
+}
+
+func FloatValue(x float64) Value {
+	return Value{f: x}
+}
+
+func BoolValue(x bool) Value {
+	return Value{b: x}
+}
+
+func StringValue(x string) Value {
+	return Value{s: x}
+}
+
+func TimeValue(x time.Time) Value {
+	return Value{i: x.UnixNano()}
+}
+
+func (v Value) Int() int64 {
+	return v.i
+}
+
+func (v Value) Float() float64 {
+	return v.f
+}
+
+func (v Value) Bool() bool {
+	return v.b
+}
+
+func (v Value) String() string {
+	return v.s
+}
+
+func (v Value) IsNull() bool {
+	return v.null
+}
+
+// Time returns the time in UTC
+func (v Value) Time() time.Time {
+	return time.Unix(0, v.i).UTC()
+}
+
+// valueOf converts a normalized value
+func valueOf(v interface{}) Value {
+	switch v := v.(type) {
+	case nil:
+		return NullValue()
+	case int64:
+		return IntValue(v)
+	case float64:
+		return FloatValue(v)
+	case bool:
+		return BoolValue(v)
+	case string:
+		return StringValue(v)
+	case time.Time:
+		return TimeValue(v)
+	default:
+		return Value{}
+	}
+}
+
+// interfaceOf converts to a normalized value of the type, nil when null
+func (v Value) interfaceOf(t Type) interface{} {
+	if v.null {
+		return nil
+	}
+	switch t {
+	case Int:
+		return v.i
+	case Float:
+		return v.f
+	case Bool:
+		return v.b
+	case String:
+		return v.s
+	case Time:
+		return v.Time()
+	default:
+		return nil
+	}
+}
+
+// toFloat converts a numeric value to float64, ints are promoted
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// arithmetic and comparison operators, others are not supported
+func supported(op token.Token) bool {
+	switch op {
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
+		token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+		token.LAND, token.LOR:
+		return true
+	default:
+		return false
+	}
+}
+
+// binaryOp applies an operator other than && and || on the operands. Ints are
+// promoted to floats when mixed with floats, the same as untyped constants of go.
+// The result is null if any operand is null.
+func binaryOp(pos token.Pos, op token.Token, x, y interface{}) (interface{}, error) {
+	if !supported(op) {
+		return nil, newError(pos, ErrUnsupported, "operator %s", op)
+	}
+	if x == nil || y == nil {
+		return nil, nil
+	}
+	if xi, ok := x.(int64); ok {
+		if yi, ok := y.(int64); ok {
+			return intOp(pos, op, xi, yi)
+		}
+	}
+	if xf, ok := toFloat(x); ok {
+		if yf, ok := toFloat(y); ok {
+			return floatOp(pos, op, xf, yf)
+		}
+	}
+	switch x := x.(type) {
+	case string:
+		if y, ok := y.(string); ok {
+			return stringOp(pos, op, x, y)
+		}
+	case bool:
+		if y, ok := y.(bool); ok {
+			return boolOp(pos, op, x, y)
+		}
+	}
+	return nil, newError(pos, ErrType, "operator %s on %s and %s", op, typeOf(x), typeOf(y))
+}
+
+func intOp(pos token.Pos, op token.Token, x, y int64) (interface{}, error) {
+	switch op {
+	case token.ADD:
+		return x + y, nil
+	case token.SUB:
+		return x - y, nil
+	case token.MUL:
+		return x * y, nil
+	case token.QUO, token.REM:
+		if y == 0 {
+			return nil, newError(pos, ErrDivByZero, "integer %s by zero", op)
+		}
+		if op == token.QUO {
+			return x / y, nil
+		}
+		return x % y, nil
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	case token.LSS:
+		return x < y, nil
+	case token.LEQ:
+		return x <= y, nil
+	case token.GTR:
+		return x > y, nil
+	case token.GEQ:
+		return x >= y, nil
+	}
+	return nil, newError(pos, ErrType, "operator %s on int", op)
+}
+
+// floatOp follows IEEE 754, division by zero results in infinity
+func floatOp(pos token.Pos, op token.Token, x, y float64) (interface{}, error) {
+	switch op {
+	case token.ADD:
+		return x + y, nil
+	case token.SUB:
+		return x - y, nil
+	case token.MUL:
+		return x * y, nil
+	case token.QUO:
+		return x / y, nil
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	case token.LSS:
+		return x < y, nil
+	case token.LEQ:
+		return x <= y, nil
+	case token.GTR:
+		return x > y, nil
+	case token.GEQ:
+		return x >= y, nil
+	}
+	return nil, newError(pos, ErrType, "operator %s on float", op)
+}
+
+func stringOp(pos token.Pos, op token.Token, x, y string) (interface{}, error) {
+	switch op {
+	case token.ADD:
+		return x + y, nil
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	case token.LSS:
+		return x < y, nil
+	case token.LEQ:
+		return x <= y, nil
+	case token.GTR:
+		return x > y, nil
+	case token.GEQ:
+		return x >= y, nil
+	}
+	return nil, newError(pos, ErrType, "operator %s on string", op)
+}
+
+func boolOp(pos token.Pos, op token.Token, x, y bool) (interface{}, error) {
+	switch op {
+	case token.EQL:
+		return x == y, nil
+	case token.NEQ:
+		return x != y, nil
+	}
+	return nil, newError(pos, ErrType, "operator %s on bool", op)
+}
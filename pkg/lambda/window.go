@@ -0,0 +1,358 @@
+package lambda
+
+import (
+	"go/ast"
+	"go/token"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSamples : default max number of samples kept for a field of a series
+const DefaultMaxSamples = 100000
+
+// aggregate functions over the history of a field, the first argument is the field
+// and the second one is a duration string like "10m", or a count for last_n.
+// last_n(field, n) is the single sample n samples before the latest one, not a
+// window of n samples, e.g. last_n(value, 1) is the previous value. It is null
+// when the history has no more than n samples.
+var aggregates = map[string]struct {
+	result Type
+	count  bool // the window is a number of samples instead of a duration
+}{
+	"mean":   {result: Float},
+	"stddev": {result: Float},
+	"delta":  {result: Float},
+	"rate":   {result: Float},
+	"count":  {result: Int},
+	"last_n": {result: Float, count: true},
+}
+
+// windowSpec : a window of a field referenced by aggregates of a program
+type windowSpec struct {
+	field    int // index of the field in Program.fields
+	duration time.Duration
+	count    int
+}
+
+// History : recent samples of the series evaluated by a program, the fields
+// referenced by aggregates are kept in ring buffers for the longest window. Safe
+// for concurrent use, but a series must be used by one goroutine at a time.
+type History struct {
+	program    *Program
+	maxSamples int
+
+	mu     sync.Mutex
+	series map[string]*Series
+}
+
+// Series : history of a series
+type Series struct {
+	history *History
+	rings   []ring   // by field
+	windows []window // by window spec
+	latest  int64    // unix nanoseconds of the latest sample
+}
+
+// ring : samples of a field in time order, grows up to max samples.
+// Samples are addressed by sequence number, first is the oldest one kept.
+type ring struct {
+	times  []int64
+	values []float64
+	head   int
+	size   int
+	first  int64
+	shift  float64 // the first value, sums are shifted by it to keep precision
+}
+
+// window : running sums of the samples within a duration, start is the sequence
+// number of the oldest sample in the window
+type window struct {
+	start int64
+	n     int
+	sum   float64 // of value - shift
+	sumSq float64
+}
+
+// NewHistory returns an empty history of the program, maxSamples limits the samples
+// kept for a field of a series, DefaultMaxSamples when not positive
+func (p *Program) NewHistory(maxSamples int) *History {
+	if maxSamples <= 0 {
+		maxSamples = DefaultMaxSamples
+	}
+	return &History{program: p, maxSamples: maxSamples, series: make(map[string]*Series)}
+}
+
+// Series returns the history of a series by key, created on first use
+func (h *History) Series(key string) *Series {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &Series{
+			history: h,
+			rings:   make([]ring, len(h.program.fields)),
+			windows: make([]window, len(h.program.windows)),
+		}
+		h.series[key] = s
+	}
+	return s
+}
+
+// Expire forgets the series without samples since the time
+func (h *History) Expire(before time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, s := range h.series {
+		if s.latest < before.UnixNano() {
+			delete(h.series, key)
+		}
+	}
+}
+
+// Len returns the number of series
+func (h *History) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.series)
+}
+
+// Add records the values of the fields referenced by aggregates from vars as samples
+// at time t. Samples older than the latest one are ignored, and so are null and NaN values.
+func (s *Series) Add(t time.Time, vars *Vars) {
+	ts := t.UnixNano()
+	if ts < s.latest {
+		return
+	}
+	s.latest = ts
+	p := s.history.program
+	for i, slot := range p.fields {
+		if vars.values[slot].null || math.IsNaN(vars.values[slot].f) {
+			continue
+		}
+		v := vars.values[slot].f
+		r := &s.rings[i]
+		if r.size == 0 {
+			r.shift = v
+		}
+		if r.size == s.history.maxSamples {
+			s.evict(i)
+		}
+		r.push(ts, v)
+		for j, spec := range p.windows {
+			if spec.field == i && spec.duration > 0 {
+				s.windows[j].add(v - r.shift)
+			}
+		}
+	}
+
+	// slide the windows and drop the samples out of all of them
+	for j, spec := range p.windows {
+		if spec.duration == 0 {
+			continue
+		}
+		r, w := &s.rings[spec.field], &s.windows[j]
+		for w.n > 0 {
+			st, v := r.get(w.start)
+			if st > ts-int64(spec.duration) {
+				break
+			}
+			w.remove(v - r.shift)
+			w.start++
+		}
+	}
+	for i := range s.rings {
+		r := &s.rings[i]
+		keep := r.first + int64(r.size) - int64(p.keep[i])
+		for j, spec := range p.windows {
+			if spec.field == i && spec.duration > 0 && s.windows[j].start < keep {
+				keep = s.windows[j].start
+			}
+		}
+		for r.first < keep && r.size > 0 {
+			r.pop()
+		}
+	}
+}
+
+// evict drops the oldest sample of a field, which is also removed from the windows
+func (s *Series) evict(field int) {
+	r := &s.rings[field]
+	_, v := r.get(r.first)
+	for j, spec := range s.history.program.windows {
+		w := &s.windows[j]
+		if spec.field == field && spec.duration > 0 && w.n > 0 && w.start == r.first {
+			w.remove(v - r.shift)
+			w.start++
+		}
+	}
+	r.pop()
+}
+
+func (r *ring) push(t int64, v float64) {
+	if r.size == len(r.times) {
+		n := 2 * len(r.times)
+		if n == 0 {
+			n = 8
+		}
+		times, values := make([]int64, n), make([]float64, n)
+		for i := 0; i < r.size; i++ {
+			times[i], values[i] = r.get(r.first + int64(i))
+		}
+		r.times, r.values, r.head = times, values, 0
+	}
+	i := (r.head + r.size) % len(r.times)
+	r.times[i], r.values[i] = t, v
+	r.size++
+}
+
+func (r *ring) pop() {
+	r.head = (r.head + 1) % len(r.times)
+	r.size--
+	r.first++
+}
+
+// get returns the sample by sequence number
+func (r *ring) get(seq int64) (int64, float64) {
+	i := (r.head + int(seq-r.first)) % len(r.times)
+	return r.times[i], r.values[i]
+}
+
+// next returns the sequence number after the newest sample
+func (r *ring) next() int64 {
+	return r.first + int64(r.size)
+}
+
+func (w *window) add(v float64) {
+	w.n++
+	w.sum += v
+	w.sumSq += v * v
+}
+
+func (w *window) remove(v float64) {
+	w.n--
+	w.sum -= v
+	w.sumSq -= v * v
+	if w.n == 0 {
+		w.sum, w.sumSq = 0, 0
+	}
+}
+
+// aggregate evaluates an aggregate function on a window of the series, the result
+// is null without enough samples
+func (s *Series) aggregate(name string, spec windowSpec, index int) Value {
+	r := &s.rings[spec.field]
+	if spec.count > 0 {
+		// the sample before the newest one by count
+		seq := r.next() - 1 - int64(spec.count)
+		if seq < r.first || r.size == 0 {
+			return NullValue()
+		}
+		_, v := r.get(seq)
+		return FloatValue(v)
+	}
+
+	w := s.windows[index]
+	switch name {
+	case "count":
+		return IntValue(int64(w.n))
+	case "mean":
+		if w.n == 0 {
+			return NullValue()
+		}
+		return FloatValue(w.sum/float64(w.n) + r.shift)
+	case "stddev":
+		if w.n == 0 {
+			return NullValue()
+		}
+		mean := w.sum / float64(w.n)
+		return FloatValue(math.Sqrt(math.Max(0, w.sumSq/float64(w.n)-mean*mean)))
+	}
+
+	// delta and rate between the oldest and the newest samples of the window
+	if w.n < 2 {
+		return NullValue()
+	}
+	t0, v0 := r.get(w.start)
+	t1, v1 := r.get(r.next() - 1)
+	if name == "delta" {
+		return FloatValue(v1 - v0)
+	}
+	if t1 == t0 {
+		return NullValue()
+	}
+	return FloatValue((v1 - v0) / (float64(t1-t0) / float64(time.Second)))
+}
+
+// SetSeries sets the history used by aggregates
+func (v *Vars) SetSeries(s *Series) {
+	v.series = s
+}
+
+// aggregate compiles a call of an aggregate function, the field must be an identifier
+// of the schema and the window a constant
+func (c *compiler) aggregate(expr *ast.CallExpr, name string) (evalFunc, Type, error) {
+	agg := aggregates[name]
+	if len(expr.Args) != 2 {
+		return nil, Invalid, newError(expr.Lparen, ErrType, "%s takes 2 arguments, %d given", name, len(expr.Args))
+	}
+	ident, ok := expr.Args[0].(*ast.Ident)
+	if !ok {
+		return nil, Invalid, newError(expr.Args[0].Pos(), ErrType, "argument 1 of %s must be a field", name)
+	}
+	_, typ, err := c.ident(ident)
+	if err != nil {
+		return nil, Invalid, err
+	}
+	if typ != Int && typ != Float {
+		return nil, Invalid, newError(ident.Pos(), ErrType, "argument 1 of %s is %s, not number", name, typ)
+	}
+
+	var spec windowSpec
+	lit, ok := expr.Args[1].(*ast.BasicLit)
+	if agg.count {
+		if ok && lit.Kind == token.INT {
+			spec.count, err = strconv.Atoi(lit.Value)
+		}
+		if !ok || lit.Kind != token.INT || err != nil || spec.count <= 0 {
+			return nil, Invalid, newError(expr.Args[1].Pos(), ErrType, "argument 2 of %s must be a positive int constant", name)
+		}
+	} else {
+		if ok && lit.Kind == token.STRING {
+			var d string
+			if d, err = strconv.Unquote(lit.Value); err == nil {
+				spec.duration, err = time.ParseDuration(d)
+			}
+		}
+		if !ok || lit.Kind != token.STRING || err != nil || spec.duration <= 0 {
+			return nil, Invalid, newError(expr.Args[1].Pos(), ErrType, "argument 2 of %s must be a positive duration like \"10m\"", name)
+		}
+	}
+
+	slot := c.slots[ident.Name]
+	spec.field = -1
+	for i, s := range c.fields {
+		if s == slot {
+			spec.field = i
+		}
+	}
+	if spec.field < 0 {
+		spec.field = len(c.fields)
+		c.fields = append(c.fields, slot)
+		c.keep = append(c.keep, 1)
+	}
+	if spec.count+1 > c.keep[spec.field] {
+		c.keep[spec.field] = spec.count + 1
+	}
+	index := len(c.windows)
+	c.windows = append(c.windows, spec)
+
+	pos := expr.Pos()
+	return func(vars *Vars) (Value, error) {
+		if vars.series == nil {
+			return Value{}, newError(pos, ErrUndefined, "history of %s", name)
+		}
+		return vars.series.aggregate(name, spec, index), nil
+	}, agg.result, nil
+}
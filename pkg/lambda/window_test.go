@@ -0,0 +1,157 @@
+package lambda
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAggregates(t *testing.T) {
+	start := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	// one sample a minute: 1, 2, ..., 10
+	var values []float64
+	for i := 1; i <= 10; i++ {
+		values = append(values, float64(i))
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{expr: `mean(value, "5m")`, want: 8},
+		{expr: `mean(value, "24h")`, want: 5.5},
+		{expr: `count(value, "3m")`, want: 3},
+		{expr: `delta(value, "5m")`, want: 4},
+		{expr: `rate(value, "5m")`, want: 1.0 / 60},
+		{expr: `stddev(value, "3m")`, want: math.Sqrt(2.0 / 3)},
+		{expr: `last_n(value, 1)`, want: 9},
+		{expr: `last_n(value, 5)`, want: 5},
+		{expr: `last_n(value, 20)`, want: math.NaN()},
+		{expr: `mean(value, "10m") > 1.5 * mean(value, "24h")`, want: 0},
+		{expr: `value - mean(value, "5m")`, want: 2},
+	}
+	for _, tt := range tests {
+		p, err := Compile(tt.expr, Schema{"value": Float})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		history := p.NewHistory(0)
+		vars := p.NewVars()
+		slot, _ := p.Slot("value")
+		series := history.Series("cpu,host=a")
+		vars.SetSeries(series)
+		for i, v := range values {
+			vars.SetFloat(slot, v)
+			series.Add(start.Add(time.Duration(i)*time.Minute), vars)
+		}
+
+		got, err := p.Run(vars)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		// NaN stands for null
+		f := math.NaN()
+		switch got := got.(type) {
+		case float64:
+			f = got
+		case int64:
+			f = float64(got)
+		case bool:
+			f = 0
+			if got {
+				f = 1
+			}
+		}
+		if math.IsNaN(tt.want) != math.IsNaN(f) || (!math.IsNaN(f) && math.Abs(f-tt.want) > 1e-9) {
+			t.Errorf("%s = %v, want %v", tt.expr, f, tt.want)
+		}
+	}
+}
+
+func TestHistoryLimits(t *testing.T) {
+	p, err := Compile(`count(value, "1h") + 0 * mean(other, "1h")`, Schema{"value": Int, "other": Float})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := p.NewHistory(3)
+	vars := p.NewVars()
+	value, _ := p.Slot("value")
+	other, _ := p.Slot("other")
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		vars.SetInt(value, int64(i))
+		vars.SetFloat(other, math.NaN())
+		series := history.Series("a")
+		series.Add(start.Add(time.Duration(i)*time.Second), vars)
+		// out of order samples are ignored
+		series.Add(start, vars)
+		vars.SetSeries(series)
+	}
+	if _, err := p.Float(vars); !errors.Is(err, ErrNull) {
+		t.Errorf("error = %v, want null of empty mean", err)
+	}
+
+	p2, _ := Compile(`count(value, "1h")`, Schema{"value": Int})
+	history = p2.NewHistory(3)
+	series := history.Series("a")
+	vars = p2.NewVars()
+	vars.SetSeries(series)
+	value, _ = p2.Slot("value")
+	for i := 0; i < 5; i++ {
+		vars.SetInt(value, int64(i))
+		series.Add(start.Add(time.Duration(i)*time.Second), vars)
+	}
+	if n, _ := p2.Run(vars); n != int64(3) {
+		t.Errorf("count = %v, want 3 of max samples", n)
+	}
+
+	history.Expire(start.Add(time.Hour))
+	if history.Len() != 0 {
+		t.Errorf("series = %d, want expired", history.Len())
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  error
+	}{
+		{expr: `mean(value)`, err: ErrType},
+		{expr: `mean(value * 2, "1m")`, err: ErrType},
+		{expr: `mean(name, "1m")`, err: ErrType},
+		{expr: `mean(value, "1 minute")`, err: ErrType},
+		{expr: `last_n(value, "1m")`, err: ErrType},
+		{expr: `last_n(value, 0)`, err: ErrType},
+		{expr: `last_n(value, -1)`, err: ErrType},
+		{expr: `mean(unknown, "1m")`, err: ErrUndefined},
+	}
+	for _, tt := range tests {
+		if _, err := Compile(tt.expr, Schema{"value": Float, "name": String}); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.expr, err, tt.err)
+		}
+	}
+
+	p, _ := Compile(`mean(value, "1m")`, Schema{"value": Float})
+	if _, err := p.Run(p.NewVars()); !errors.Is(err, ErrUndefined) {
+		t.Errorf("error = %v, want undefined history", err)
+	}
+
+	// null of a series without samples
+	p, _ = Compile(`last_n(value, 1)`, Schema{"value": Float})
+	vars := p.NewVars()
+	vars.SetSeries(p.NewHistory(0).Series("cpu,host=a"))
+	if v, err := p.Run(vars); err != nil || v != nil {
+		t.Errorf("last_n of empty history = %v, %v, want null", v, err)
+	}
+	if _, err := p.Float(vars); !errors.Is(err, ErrNull) {
+		t.Errorf("error = %v, want null", err)
+	}
+	expr, _ := Parse(`mean(value, "1m")`)
+	if _, err := Eval(expr, map[string]interface{}{"value": 1.0}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("error = %v, want unsupported", err)
+	}
+	if err := Register("mean", Func{Result: Float, Call: func([]Value) (Value, error) { return Value{}, nil }}); err == nil {
+		t.Error("aggregate replaced")
+	}
+}
@@ -0,0 +1,17 @@
+package models
+
+// APIKey : key authenticating the devices of a project writing into the gateway,
+// only the sha256 hash of the key is stored
+type APIKey struct {
+	KeyHash     string `gorm:"column:key_hash;primaryKey;size:64;not null" json:"-"`
+	ProjectId   int    `gorm:"column:project_id;not null;index" json:"project_id"`
+	Device      string `gorm:"column:device" json:"device"`
+	Enabled     bool   `gorm:"column:enabled;not null;default:true" json:"enabled"`
+	Created     string `gorm:"column:CREATEDATE;->" json:"created"`
+	Updated     string `gorm:"column:UPDATEDATE;->" json:"updated"`
+	Description string `gorm:"column:DESCRIPTION" json:"description"`
+}
+
+func (k APIKey) TableName() string {
+	return "gateway_api_key"
+}
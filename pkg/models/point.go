@@ -493,6 +493,10 @@ func GetPrecisionMultiplier(precision string) int64 {
 		d = time.Millisecond
 	case "s":
 		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
 	}
 	return int64(d)
 }
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+// LineScanner reads line protocol from a reader one line at a time, so large
+// inputs need not be buffered completely. A newline inside a quoted string field
+// does not end a line. Empty lines and comments are skipped.
+type LineScanner struct {
+	reader *bufio.Reader
+	line   []byte
+	num    int // line number of the current line
+	next   int // line number of the next line to read
+	err    error
+}
+
+// NewLineScanner returns a LineScanner reading from r.
+func NewLineScanner(r io.Reader) *LineScanner {
+	return &LineScanner{reader: bufio.NewReader(r), next: 1}
+}
+
+// Scan advances the scanner to the next line, which is then available through
+// Bytes. It returns false when the input is exhausted or an error occurred.
+func (s *LineScanner) Scan() bool {
+	for s.err == nil {
+		block, err := s.readBlock()
+		if err != nil && (err != io.EOF || len(block) == 0) {
+			s.err = err
+			return false
+		}
+		s.num = s.next
+		s.next += bytes.Count(block, []byte{'\n'})
+
+		// strip the newline if one is present
+		if len(block) > 0 && block[len(block)-1] == '\n' {
+			block = block[:len(block)-1]
+		}
+		if len(block) > 0 && block[len(block)-1] == '\r' {
+			block = block[:len(block)-1]
+		}
+
+		start := skipWhitespace(block, 0)
+		// If line is all whitespace, just skip it
+		if start >= len(block) {
+			continue
+		}
+		// lines which start with '#' are comments
+		if block[start] == '#' {
+			continue
+		}
+		s.line = block[start:]
+		return true
+	}
+	return false
+}
+
+// readBlock reads until a newline which is not quoted
+func (s *LineScanner) readBlock() ([]byte, error) {
+	var block []byte
+	for {
+		buf, err := s.reader.ReadBytes('\n')
+		block = append(block, buf...)
+		if err != nil {
+			return block, err
+		}
+		// the newline found is the end of line unless it is quoted
+		if i, _ := scanLine(block, 0); i == len(block)-1 {
+			return block, nil
+		}
+	}
+}
+
+// Bytes returns the current line without the trailing newline. The slice is not
+// reused by later calls to Scan, so points parsed from it remain valid.
+func (s *LineScanner) Bytes() []byte {
+	return s.line
+}
+
+// Line returns the 1-based line number of the current line in the input.
+func (s *LineScanner) Line() int {
+	return s.num
+}
+
+// Err returns the first non-EOF error encountered by the scanner.
+func (s *LineScanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// ParseLineWithPrecision parses a single line returned by LineScanner into a point.
+func ParseLineWithPrecision(line []byte, defaultTime time.Time, precision string) (Point, error) {
+	return parsePoint(line, defaultTime, precision)
+}
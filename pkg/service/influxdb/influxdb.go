@@ -3,7 +3,9 @@ package influxdb
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"golang.org/x/sync/semaphore"
@@ -83,6 +85,55 @@ func CloseClient() {
 	GetClient().Close()
 }
 
+// GetAccount : return the account used by the initialized client
+func GetAccount() Account {
+	if influxClient == nil {
+		panic("influx client not init yeat")
+	}
+	return Account{
+		Address: influxClient.Address,
+		Bucket:  influxClient.Bucket,
+		Token:   influxClient.Token,
+		Org:     influxClient.Org,
+	}
+}
+
+// WriteOptions : batching and retry options of writes, applied by the writer of the caller
+type WriteOptions struct {
+	BatchSize     uint          `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	MaxRetries    uint          `yaml:"max_retries"`
+}
+
+func (o WriteOptions) Validate() error {
+	if o.BatchSize == 0 {
+		return fmt.Errorf("influxdb: batch size must be positive")
+	}
+	if o.FlushInterval < time.Millisecond {
+		return fmt.Errorf("influxdb: flush interval must be at least 1ms")
+	}
+	if o.RetryInterval < time.Millisecond {
+		return fmt.Errorf("influxdb: retry interval must be at least 1ms")
+	}
+	return nil
+}
+
+// NewWriteClient : create a client dedicated to writing, which shares the account of the
+// initialized client. Writes are expected through the blocking write api, so the caller
+// knows whether a batch is stored: the non-blocking api reports failures only and never
+// confirms a write, batching and retries as described by WriteOptions are up to the caller.
+// The http client of requests is optional, the default one is used when nil.
+// The caller is responsible for closing the returned client.
+func NewWriteClient(httpClient *http.Client) influxdb2.Client {
+	account := GetAccount()
+	options := influxdb2.DefaultOptions()
+	if httpClient != nil {
+		options.SetHTTPClient(httpClient)
+	}
+	return influxdb2.NewClientWithOptions(account.Address, account.Token, options)
+}
+
 func Query(script string, ctx context.Context) ([]*Point, error) {
 	queryApi := GetClient().QueryAPI(influxClient.Org)
 	raw, err := queryApi.Query(ctx, script)
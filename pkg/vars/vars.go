@@ -13,4 +13,6 @@ const (
 
 	SERVICE_PORT = "SERVICE_PORT"
 	SERVICE_NAME = "SERVICE_NAME"
+
+	GATEWAY_CONFIG = "GATEWAY_CONFIG"
 )